@@ -0,0 +1,454 @@
+// Command extsort generates, sorts, verifies and benchmarks files of
+// key\tword\tdate records with the algorithms of the extsort package.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ReilEgor/Algo_Lr1_SequentialSortingAlgorithms/extsort"
+)
+
+const usage = `usage: extsort <command> [flags]
+
+commands:
+  generate  write a file of random records
+  sort      sort a file by key
+  verify    check that a file is sorted by key and holds the records of its input
+  bench     time the sorting algorithms on the same input
+  cleanup   remove the temporary files left by sorts that did not finish
+
+run "extsort <command> -h" for the command flags.
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	commands := map[string]func(args []string) error{
+		"generate": runGenerate,
+		"sort":     runSort,
+		"verify":   runVerify,
+		"bench":    runBench,
+		"cleanup":  runCleanup,
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := cmd(os.Args[2:]); err != nil {
+		log.Fatalf("%s: %v", os.Args[1], err)
+	}
+}
+
+// sortFlags are the flags shared by the commands that run a sort.
+type sortFlags struct {
+	algo       string
+	tempDir    string
+	memLimit   int64
+	chunkLines int
+	runs       string
+	adaptive   bool
+	stable     bool
+	desc       bool
+	workers    int
+	fanIn      int
+	tapes      int
+	ways       int
+	compress   string
+}
+
+func (f *sortFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.algo, "algo", "kway", "sorting algorithm: "+strings.Join(extsort.Algorithms, "|"))
+	fs.StringVar(&f.tempDir, "tmp", "", "comma-separated directories for temporary files, used in turn (default the system temp directory)")
+	fs.Int64Var(&f.memLimit, "mem", 300, "memory budget in MB, also set as the runtime soft limit")
+	fs.IntVar(&f.chunkLines, "chunk", 0, "cap on records kept in memory while building runs (default no cap)")
+	fs.StringVar(&f.runs, "runs", extsort.RunsSorted, "run generation of chunked and kway: sort|replacement")
+	fs.BoolVar(&f.adaptive, "adaptive", false, "shrink the runs of chunked and kway under memory pressure and grow them back after")
+	fs.BoolVar(&f.stable, "stable", false, "keep records with equal keys in input order (not with polyphase)")
+	fs.BoolVar(&f.desc, "desc", false, "sort from the largest key down")
+	fs.IntVar(&f.workers, "workers", 0, "chunks sorted concurrently by kway (default GOMAXPROCS)")
+	fs.IntVar(&f.fanIn, "fanin", 0, "most runs kway merges at once (default from open file limit and -mem)")
+	fs.IntVar(&f.tapes, "tapes", 0, "number of tapes of the polyphase merge (default 4)")
+	fs.IntVar(&f.ways, "ways", 0, "runs merged at once by the balanced merge (default 4)")
+	fs.StringVar(&f.compress, "compress", extsort.CompressionNone, "compression of temporary runs: none|gzip|lz")
+}
+
+func (f *sortFlags) options() extsort.Options {
+	if f.memLimit > 0 {
+		debug.SetMemoryLimit(f.memLimit * 1024 * 1024)
+	}
+	return extsort.Options{
+		Config: extsort.Config{
+			TempDirs:    f.tempDirs(),
+			MemoryLimit: f.memLimit * 1024 * 1024,
+			Order:       extsort.Order{Descending: f.desc},
+			Compression: f.compress,
+		},
+		Algorithm:     f.algo,
+		ChunkLines:    f.chunkLines,
+		RunGeneration: f.runs,
+		AdaptiveRuns:  f.adaptive,
+		Stable:        f.stable,
+		Workers:       f.workers,
+		MaxFanIn:      f.fanIn,
+		Tapes:         f.tapes,
+		Ways:          f.ways,
+	}
+}
+
+func (f *sortFlags) tempDirs() []string {
+	if f.tempDir == "" {
+		return nil
+	}
+	return strings.Split(f.tempDir, ",")
+}
+
+// newCompressionStats returns the statistics to collect for opts, if its
+// runs are compressed.
+func newCompressionStats(opts extsort.Options) *extsort.CompressionStats {
+	if opts.Compression == "" || opts.Compression == extsort.CompressionNone {
+		return nil
+	}
+	return &extsort.CompressionStats{}
+}
+
+func printCompression(stats *extsort.CompressionStats) {
+	if stats == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Temporary runs: %.1f MB compressed to %.1f MB (ratio %.2f), compression %.2fs, decompression %.2fs\n",
+		float64(stats.RawBytes)/(1<<20), float64(stats.CompressedBytes)/(1<<20), stats.Ratio(),
+		stats.CompressTime.Seconds(), stats.DecompressTime.Seconds())
+}
+
+func runGenerate(args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	output := fs.String("out", "A.txt", "output file")
+	lines := fs.Int("lines", 300000, "number of records")
+	keys := fs.Int("keys", 300000, "keys are drawn from [0, keys)")
+	fs.Parse(args)
+
+	if err := checkGenerate(*lines, *keys); err != nil {
+		return err
+	}
+	return extsort.GenerateFile(*output, *lines, *keys)
+}
+
+// checkGenerate validates the -lines and -keys flags of a generated file.
+func checkGenerate(lines, keys int) error {
+	if lines < 0 {
+		return fmt.Errorf("-lines must not be negative, got %d", lines)
+	}
+	if keys <= 0 {
+		return fmt.Errorf("-keys must be positive, got %d", keys)
+	}
+	return nil
+}
+
+func runSort(args []string) error {
+	fs := flag.NewFlagSet("sort", flag.ExitOnError)
+	input := fs.String("in", "A.txt", `input file, "-" for stdin`)
+	output := fs.String("out", "", `output file, "-" for stdout`)
+	inPlace := fs.Bool("inplace", false, "replace the input with the sorted records")
+	checkpoint := fs.Bool("checkpoint", false, "save progress so that a failed sort can be resumed")
+	resume := fs.String("resume", "", "job directory of a checkpointed sort to finish into -out")
+	timeout := fs.Duration("timeout", 0, "stop the sort after this long, e.g. 5m (default no limit)")
+	progress := fs.Bool("progress", isTerminal(os.Stderr), "draw a progress bar on stderr (default when stderr is a terminal)")
+	statsFile := fs.String("stats", "", `write a JSON report of the sort to this file, "-" for stdout`)
+	var sf sortFlags
+	sf.register(fs)
+	var mf monitorFlags
+	mf.register(fs)
+	fs.Parse(args)
+
+	if *statsFile == "-" && *output == "-" {
+		return fmt.Errorf("-stats and -out cannot both be stdout")
+	}
+	if *resume != "" {
+		if *output == "" {
+			return fmt.Errorf("no -out given for the resumed sort")
+		}
+		opts := sf.options()
+		if *progress {
+			opts.Progress = progressBar(os.Stderr)
+		}
+		if *statsFile != "" {
+			opts.Stats = &extsort.Stats{}
+		}
+		if err := resumeSort(*resume, *output, opts, *timeout, mf); err != nil {
+			return err
+		}
+		return writeStats(*statsFile, opts.Stats)
+	}
+	if *output == "" {
+		if !*inPlace {
+			return fmt.Errorf("no -out given; use -inplace to replace the input")
+		}
+		*output = *input
+	}
+	opts := sf.options()
+	opts.InPlace = *inPlace
+	opts.Checkpoint = *checkpoint
+	if *progress {
+		opts.Progress = progressBar(os.Stderr)
+	}
+	if *statsFile != "" {
+		opts.Stats = &extsort.Stats{}
+	}
+	opts.CompressionStats = newCompressionStats(opts)
+	ctx, stop := withSignals(*timeout)
+	defer stop()
+	ctx, stopMonitor, err := mf.start(ctx, opts.MemoryLimit)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if *input == "-" || *output == "-" {
+		err = sortStream(ctx, *input, *output, opts)
+	} else {
+		err = extsort.SortFile(ctx, *input, *output, opts)
+	}
+	if merr := stopMonitor(); err == nil {
+		err = merr
+	}
+	if err != nil {
+		printResume(err, *output)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Sorting completed in %.2f seconds\n", time.Since(start).Seconds())
+	printCompression(opts.CompressionStats)
+	return writeStats(*statsFile, opts.Stats)
+}
+
+// resumeSort finishes the checkpointed sort of job into output.
+func resumeSort(job, output string, opts extsort.Options, timeout time.Duration, mf monitorFlags) error {
+	opts.CompressionStats = &extsort.CompressionStats{}
+	ctx, stop := withSignals(timeout)
+	defer stop()
+	ctx, stopMonitor, err := mf.start(ctx, opts.MemoryLimit)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if output == "-" {
+		err = extsort.Resume(ctx, job, os.Stdout, opts)
+	} else {
+		err = extsort.ResumeFile(ctx, job, output, opts)
+	}
+	if merr := stopMonitor(); err == nil {
+		err = merr
+	}
+	if err != nil {
+		printResume(err, output)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Sorting completed in %.2f seconds\n", time.Since(start).Seconds())
+	if opts.CompressionStats.CompressedBytes > 0 {
+		printCompression(opts.CompressionStats)
+	}
+	return nil
+}
+
+// writeStats writes v as indented JSON to the file name, or to stdout if name
+// is "-". It does nothing if name is empty.
+func writeStats(name string, v any) error {
+	if name == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if name == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+// printResume tells how to go on with a sort that failed after a checkpoint.
+func printResume(err error, output string) {
+	var re *extsort.ResumableError
+	if errors.As(err, &re) {
+		fmt.Fprintf(os.Stderr, "Progress saved; finish with: extsort sort -resume %s -out %s\n", re.Job, output)
+	}
+}
+
+// withSignals returns a context canceled by SIGINT or SIGTERM, or once
+// timeout passes if it is not zero, so that the sort stops and removes its
+// temporary files, or keeps them for -resume if it saved a checkpoint. A
+// second signal removes them right away and exits.
+func withSignals(timeout time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sigs:
+		case <-ctx.Done():
+			return
+		}
+		fmt.Fprintln(os.Stderr, "Interrupted, stopping the sort")
+		cancel()
+		<-sigs
+		extsort.RemoveTempFiles()
+		os.Exit(130)
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
+// sortStream sorts when the input or the output is a standard stream. An
+// output file is replaced only once the sort succeeds, as by SortFile.
+func sortStream(ctx context.Context, input, output string, opts extsort.Options) error {
+	if output != "-" {
+		return extsort.SortToFile(ctx, os.Stdin, output, opts)
+	}
+	in := os.Stdin
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	return extsort.Sort(ctx, in, os.Stdout, opts)
+}
+
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	input := fs.String("in", "A.txt", "file to check")
+	orig := fs.String("orig", "", "unsorted file -in was sorted from, to check that both hold the same records")
+	desc := fs.Bool("desc", false, "check that the keys never increase instead")
+	fs.Parse(args)
+
+	var want *extsort.Digest
+	if *orig != "" {
+		d, err := extsort.DigestFile(*orig)
+		if err != nil {
+			return fmt.Errorf("%s: %w", *orig, err)
+		}
+		want = &d
+	}
+	order := extsort.Order{Descending: *desc}
+	report, err := order.VerifyFile(*input, want)
+	if report.Disorders > 1 {
+		fmt.Fprintf(os.Stderr, "%s: %d records out of order\n", *input, report.Disorders)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", *input, err)
+	}
+	fmt.Printf("%s: %d records sorted\n", *input, report.Digest.Records)
+	if want != nil {
+		fmt.Printf("%s: same records as %s (digest %016x)\n", *input, *orig, report.Digest.Sum)
+	}
+	return nil
+}
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	input := fs.String("in", "", "input file (default generate one in the temp directory)")
+	lines := fs.Int("lines", 300000, "number of records to generate")
+	keys := fs.Int("keys", 300000, "generated keys are drawn from [0, keys)")
+	algos := fs.String("algos", strings.Join(extsort.Algorithms, ","), "comma-separated algorithms to run")
+	statsFile := fs.String("stats", "", `write the JSON reports of the sorts to this file, "-" for stdout`)
+	var sf sortFlags
+	sf.register(fs)
+	fs.Parse(args)
+
+	opts := sf.options()
+	ctx, stop := withSignals(0)
+	defer stop()
+
+	// The input and output go to the first temporary directory.
+	benchDir := os.TempDir()
+	if dirs := sf.tempDirs(); len(dirs) > 0 {
+		benchDir = dirs[0]
+	}
+	if *input == "" {
+		if err := checkGenerate(*lines, *keys); err != nil {
+			return err
+		}
+		*input = filepath.Join(benchDir, "bench_input.txt")
+		if err := extsort.GenerateFile(*input, *lines, *keys); err != nil {
+			return err
+		}
+		defer os.Remove(*input)
+	}
+	output := filepath.Join(benchDir, "bench_output.txt")
+	defer os.Remove(output)
+	want, err := extsort.DigestFile(*input)
+	if err != nil {
+		return err
+	}
+
+	var reports []*extsort.Stats
+	for _, algo := range strings.Split(*algos, ",") {
+		opts.Algorithm = algo
+		opts.CompressionStats = newCompressionStats(opts)
+		opts.Stats = &extsort.Stats{}
+		reports = append(reports, opts.Stats)
+
+		start := time.Now()
+		if err := extsort.SortFile(ctx, *input, output, opts); err != nil {
+			return fmt.Errorf("%s: %w", algo, err)
+		}
+		elapsed := time.Since(start).Seconds()
+		if _, err := opts.Order.VerifyFile(output, &want); err != nil {
+			return fmt.Errorf("%s: wrong output: %w", algo, err)
+		}
+		if stats := opts.CompressionStats; stats != nil {
+			fmt.Printf("%-10s %8.2fs  ratio %5.2f  codec %6.2fs\n", algo, elapsed, stats.Ratio(),
+				(stats.CompressTime + stats.DecompressTime).Seconds())
+		} else {
+			fmt.Printf("%-10s %8.2fs\n", algo, elapsed)
+		}
+	}
+	return writeStats(*statsFile, reports)
+}
+
+func runCleanup(args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	tempDir := fs.String("tmp", "", "comma-separated directories to clean (default the system temp directory)")
+	dryRun := fs.Bool("n", false, "only list what would be removed")
+	resumable := fs.Bool("resumable", false, "also remove checkpointed sorts that could be resumed")
+	fs.Parse(args)
+
+	var dirs []string
+	if *tempDir != "" {
+		dirs = strings.Split(*tempDir, ",")
+	}
+	orphans, err := extsort.RemoveOrphans(dirs, *dryRun, *resumable)
+	for _, dir := range orphans {
+		fmt.Println(dir)
+	}
+	return err
+}
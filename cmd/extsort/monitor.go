@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ReilEgor/Algo_Lr1_SequentialSortingAlgorithms/extsort"
+)
+
+// monitorFlags configure the memory monitor of a sort.
+type monitorFlags struct {
+	interval time.Duration
+	log      string
+	strict   bool
+}
+
+func (f *monitorFlags) register(fs *flag.FlagSet) {
+	fs.DurationVar(&f.interval, "monitor", 0, "sample the memory this often and report the peaks (default off, 500ms with -memlog or -strict)")
+	fs.StringVar(&f.log, "memlog", "", `write every memory sample as a JSON line to this file, "-" for stderr`)
+	fs.BoolVar(&f.strict, "strict", false, "fail the sort once the memory goes over -mem")
+}
+
+// start starts the memory monitor over ctx if the flags ask for one. The
+// returned stop function stops it, prints its peaks and returns the breach
+// of a strict monitor.
+func (f *monitorFlags) start(ctx context.Context, limit int64) (context.Context, func() error, error) {
+	if f.interval == 0 && f.log == "" && !f.strict {
+		return ctx, func() error { return nil }, nil
+	}
+	opts := extsort.MonitorOptions{Interval: f.interval, Limit: limit, Strict: f.strict}
+	var logFile io.WriteCloser
+	if f.log != "" {
+		logFile = os.Stderr
+		if f.log != "-" {
+			file, err := os.Create(f.log)
+			if err != nil {
+				return ctx, nil, err
+			}
+			logFile = file
+		}
+		enc := json.NewEncoder(logFile)
+		opts.Events = func(e extsort.MemoryEvent) {
+			enc.Encode(e)
+		}
+	}
+
+	ctx, monitor := extsort.StartMemoryMonitor(ctx, opts)
+	return ctx, func() error {
+		report, err := monitor.Stop()
+		if logFile != nil && logFile != os.Stderr {
+			logFile.Close()
+		}
+		fmt.Fprintf(os.Stderr, "Memory: peak heap %.1f MB, peak RSS %.1f MB, %d GC cycles, %d breaches of %d MB\n",
+			float64(report.PeakHeapBytes)/(1<<20), float64(report.PeakRSSBytes)/(1<<20),
+			report.GCCycles, report.Breaches, limit>>20)
+		return err
+	}, nil
+}
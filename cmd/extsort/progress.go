@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ReilEgor/Algo_Lr1_SequentialSortingAlgorithms/extsort"
+)
+
+// barWidth is the number of cells of the progress bar.
+const barWidth = 30
+
+// isTerminal reports whether f is a character device, such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBar returns a ProgressFunc that draws a progress bar of the phase
+// on a single line of w.
+func progressBar(w io.Writer) extsort.ProgressFunc {
+	width := 0
+	return func(p extsort.Progress) {
+		var line string
+		if p.Phase == extsort.PhaseDone {
+			line = fmt.Sprintf("done: %s in %s", formatBytes(p.Bytes), p.Elapsed.Round(time.Second))
+		} else {
+			line = formatProgress(p)
+		}
+		// Blank out what is left of a longer line drawn before.
+		pad := max(width-len(line), 0)
+		width = len(line)
+		fmt.Fprintf(w, "\r%s%s", line, strings.Repeat(" ", pad))
+		if p.Phase == extsort.PhaseDone {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+func formatProgress(p extsort.Progress) string {
+	var b strings.Builder
+	if p.TotalBytes > 0 {
+		done := min(float64(p.Bytes)/float64(p.TotalBytes), 1)
+		cells := int(done * barWidth)
+		fmt.Fprintf(&b, "[%s%s] %3.0f%% ", strings.Repeat("=", cells), strings.Repeat(" ", barWidth-cells), done*100)
+	}
+	b.WriteString(p.Phase)
+	if p.Pass > 0 {
+		fmt.Fprintf(&b, " pass %d", p.Pass)
+	}
+	if p.TotalBytes > 0 {
+		fmt.Fprintf(&b, "  %s / %s", formatBytes(p.Bytes), formatBytes(p.TotalBytes))
+	} else {
+		fmt.Fprintf(&b, "  %s", formatBytes(p.Bytes))
+	}
+	fmt.Fprintf(&b, "  runs %d  %s", p.Runs, p.Elapsed.Round(time.Second))
+	if p.ETA > 0 {
+		fmt.Fprintf(&b, "  ETA %s", p.ETA.Round(time.Second))
+	}
+	return b.String()
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+}
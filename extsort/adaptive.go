@@ -0,0 +1,70 @@
+package extsort
+
+import "runtime/metrics"
+
+const (
+	// A run built while the garbage collector took more than highGCShare of
+	// the CPU time is followed by one half as large, and one built while it
+	// took less than lowGCShare by one a quarter larger.
+	highGCShare = 0.25
+	lowGCShare  = 0.05
+	// minRunShare is the smallest fraction of its planned memory a run is
+	// shrunk to.
+	minRunShare = 16
+)
+
+// The CPU time metrics are estimates updated by every garbage collection.
+var pressureMetrics = []string{"/cpu/classes/gc/total:cpu-seconds", "/cpu/classes/total:cpu-seconds"}
+
+// runSizer adapts the memory of the runs built in memory to the pressure on
+// it. The garbage collector works harder as the heap nears the runtime
+// memory limit, so the share of CPU time it took while a run was built
+// tells whether the next run should shrink or may grow back. A run also
+// never takes more than half the memory the system has left, so the sort
+// gives way to the other processes. Runs never grow past the memory the
+// budget planned for them.
+type runSizer struct {
+	max, min int64
+	gcCPU    float64 // at the start of the run
+	allCPU   float64
+}
+
+func newRunSizer(planned int64) *runSizer {
+	z := &runSizer{max: planned, min: max(planned/minRunShare, 1)}
+	z.gcCPU, z.allCPU = readCPU()
+	return z
+}
+
+// next returns the memory of the run that follows a run of size bytes.
+func (z *runSizer) next(size int64) int64 {
+	gcCPU, allCPU := readCPU()
+	if allCPU > z.allCPU {
+		share := (gcCPU - z.gcCPU) / (allCPU - z.allCPU)
+		switch {
+		case share > highGCShare:
+			size /= 2
+		case share < lowGCShare:
+			size += size / 4
+		}
+	}
+	z.gcCPU, z.allCPU = gcCPU, allCPU
+
+	if avail, ok := availableMemory(); ok {
+		size = min(size, int64(avail/2))
+	}
+	return min(max(size, z.min), z.max)
+}
+
+// readCPU returns the CPU seconds taken by the garbage collector and by the
+// whole process.
+func readCPU() (gc, all float64) {
+	samples := make([]metrics.Sample, len(pressureMetrics))
+	for i, name := range pressureMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindFloat64 || samples[1].Value.Kind() != metrics.KindFloat64 {
+		return 0, 0
+	}
+	return samples[0].Value.Float64(), samples[1].Value.Float64()
+}
@@ -0,0 +1,194 @@
+package extsort
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const defaultBalancedWays = 4
+
+// BalancedMerge is the balanced multiway natural merge sort. The natural runs
+// of the input are distributed round-robin over Ways tapes; every pass then
+// merges Ways runs at a time onto the other Ways tapes, again round-robin,
+// and the two groups swap roles. The input is never copied back, so a sort of
+// n runs takes about log_Ways(n) passes.
+type BalancedMerge struct {
+	Config
+	// Ways is the number of runs merged at once. The merge uses 2*Ways tapes.
+	// Zero selects 4.
+	Ways int
+}
+
+func (s BalancedMerge) Sort(ctx context.Context, r io.Reader, w io.Writer) (err error) {
+	k := s.Ways
+	if k == 0 {
+		k = defaultBalancedWays
+	}
+	if k < 2 {
+		return fmt.Errorf("balanced merge needs at least 2 ways, got %d", k)
+	}
+
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+
+	dirs, err := newTempDirs(s.TempDirs)
+	if err != nil {
+		return err
+	}
+	cp := newCheckpoint(s.Checkpoint, "balanced", c, s.Order, dirs)
+	progress := newProgress("balanced", s.Progress, s.Stats, r, balancedSweeps(k))
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	defer func() {
+		err = cp.finish(dirs, err)
+		progress.finish(err)
+	}()
+	groups := balancedGroups(dirs, k)
+	progress.phase(PhaseRuns, 0, 0, false)
+
+	// Both groups of tapes are open during a pass.
+	bufSize := newMemoryBudget(s.MemoryLimit, c).mergeBuffer(k, k)
+	src, err := newInputReader(r, bufSize)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	dist, err := distributeRuns(ctx, st, src, bufSize, c, groups[0]...)
+	if err != nil {
+		return fmt.Errorf("failed to distribute runs: %w", err)
+	}
+	if err := cp.save("passes", 0, dist...); err != nil {
+		return err
+	}
+	return mergeBalanced(ctx, st, groups, dist, 0, w, bufSize, c, cp)
+}
+
+// resume goes on with the pass after the last one saved. The number of ways
+// is that of the job.
+func (s BalancedMerge) resume(ctx context.Context, cp *checkpoint, dirs tempDirs, w io.Writer) (err error) {
+	k := len(cp.m.Tapes)
+	if k < 2 {
+		return fmt.Errorf("invalid checkpoint: %d tapes", k)
+	}
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+	progress := newProgress("balanced", s.Progress, s.Stats, nil, balancedSweeps(k))
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	c.disk.reopened(cp.m.Tapes...)
+	defer func() { progress.finish(err) }()
+	bufSize := newMemoryBudget(s.MemoryLimit, c).mergeBuffer(k, k)
+	return mergeBalanced(ctx, st, balancedGroups(dirs, k), cp.m.Tapes, cp.m.Step, w, bufSize, c, cp)
+}
+
+// balancedSweeps estimates the passes of the balanced merge of k ways.
+func balancedSweeps(k int) sweepFunc {
+	return func(runs int) int { return mergeSweeps(runs, k) }
+}
+
+// balancedGroups names the two groups of k tapes each.
+func balancedGroups(dirs tempDirs, k int) [2][]string {
+	var groups [2][]string
+	for g := range groups {
+		groups[g] = make([]string, k)
+		for i := range k {
+			groups[g][i] = dirs.path(g*k+i, fmt.Sprintf("tape_%d.tmp", g*k+i))
+		}
+	}
+	return groups
+}
+
+// mergeBalanced merges the tapes, the output of pass passes, until at most
+// one run per tape is left, and merges those into w.
+func mergeBalanced(ctx context.Context, st *sortState, groups [2][]string, tapes []tapeFile, pass int, w io.Writer, bufSize int, c codec, cp *checkpoint) error {
+	progress := st.progress
+	in, out := pass%2, (pass+1)%2
+	for ; totalRuns(tapes) > len(tapes); pass++ {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		progress.phase(PhaseMerge, pass+1, totalRuns(tapes), true)
+		written, err := mergeBalancedPass(ctx, st, groups[in], groups[out], bufSize, c)
+		if err != nil {
+			return fmt.Errorf("failed to merge files: %w", err)
+		}
+		if err := cp.save("passes", pass+1, written...); err != nil {
+			return err
+		}
+		tapes = written
+		in, out = out, in
+	}
+
+	progress.phase(PhaseMerge, pass+1, totalRuns(tapes), true)
+	writer := newOutputWriter(w, bufSize)
+	if err := mergeGroup(ctx, st, groups[in], []*tapeWriter{writer}, bufSize, c); err != nil {
+		return fmt.Errorf("failed to merge files: %w", err)
+	}
+	return writer.Close()
+}
+
+// mergeBalancedPass merges the runs of the inputs onto the outputs and
+// returns the outputs with their run counts.
+func mergeBalancedPass(ctx context.Context, st *sortState, inputs, outputs []string, bufSize int, c codec) ([]tapeFile, error) {
+	writers := make([]*tapeWriter, len(outputs))
+	for i, name := range outputs {
+		out, err := createTape(name, bufSize, c)
+		if err != nil {
+			return nil, err
+		}
+		defer out.Close()
+		writers[i] = out
+	}
+
+	if err := mergeGroup(ctx, st, inputs, writers, bufSize, c); err != nil {
+		return nil, err
+	}
+
+	written := make([]tapeFile, len(writers))
+	for i, out := range writers {
+		if err := out.Close(); err != nil {
+			return nil, err
+		}
+		written[i] = out.tapeFile()
+	}
+	return written, nil
+}
+
+// mergeGroup merges the i-th runs of all input tapes into one run and writes
+// it to the writers in turn, until the inputs are exhausted.
+func mergeGroup(ctx context.Context, st *sortState, inputs []string, writers []*tapeWriter, bufSize int, c codec) error {
+	readers := make([]*runReader, len(inputs))
+	for i, name := range inputs {
+		t, err := openTape(name, bufSize, true, c)
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+		readers[i] = t
+	}
+
+	check := newBatchCheck(ctx, st)
+	defer check.flush()
+	active := make([]*runReader, 0, len(readers))
+	for merged := 0; ; merged++ {
+		active = active[:0]
+		for _, t := range readers {
+			if t.inRun {
+				active = append(active, t)
+			}
+		}
+		if len(active) == 0 {
+			return nil
+		}
+
+		out := writers[merged%len(writers)]
+		out.beginRun()
+		if err := mergeRuns(check, out, active); err != nil {
+			return err
+		}
+	}
+}
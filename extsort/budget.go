@@ -0,0 +1,92 @@
+package extsort
+
+import (
+	"bufio"
+	"io"
+	"unsafe"
+)
+
+const (
+	// DefaultMemoryLimit is the memory budget of a sort when Options.MemoryLimit is zero.
+	DefaultMemoryLimit = 300 << 20
+
+	// maxLineSize is the longest line accepted. Buffers are never smaller,
+	// so reading a line never grows them past what the budget accounts for.
+	maxLineSize   = bufio.MaxScanTokenSize
+	minBufferSize = maxLineSize
+	maxBufferSize = 4 << 20
+
+	// recordOverhead is the memory a record held in a run costs on top of its
+	// line: the item itself, the spare capacity of the growing slice and the
+	// rounding of the allocator.
+	recordOverhead = 2*int64(unsafe.Sizeof(selectionItem{})) + 16
+)
+
+// memoryBudget is the number of bytes a sort may use. Half of it is left as
+// headroom for the garbage collector; the other half is shared between the
+// open files and the records of the run being built. An open file costs its
+// buffer and, if the tapes are compressed, the state of its codec.
+type memoryBudget struct {
+	limit  int64
+	reader int64 // codec state of a tape being read
+	writer int64 // codec state of a tape being written
+}
+
+func newMemoryBudget(limit int64, c codec) memoryBudget {
+	if limit <= 0 {
+		limit = DefaultMemoryLimit
+	}
+	reader, writer := c.memory()
+	return memoryBudget{limit: limit, reader: reader, writer: writer}
+}
+
+func (b memoryBudget) usable() int64 {
+	return b.limit / 2
+}
+
+// codecs is the codec state of reads tapes being read and writes tapes
+// being written.
+func (b memoryBudget) codecs(reads, writes int) int64 {
+	return int64(reads)*b.reader + int64(writes)*b.writer
+}
+
+// ioBuffer is the buffer size of a file read or written while a run is built
+// in memory, where buffers should take only a small part of the budget.
+func (b memoryBudget) ioBuffer() int {
+	return clampBuffer(b.usable() / 64)
+}
+
+// mergeBuffer is the buffer size of each file open during a merge that reads
+// reads tapes and writes writes, where the buffers and the codecs are all
+// the memory there is to use.
+func (b memoryBudget) mergeBuffer(reads, writes int) int {
+	return clampBuffer((b.usable() - b.codecs(reads, writes)) / int64(reads+writes))
+}
+
+// mergeWays is the number of tapes a merge into one tape can read with
+// buffers of at least minBufferSize.
+func (b memoryBudget) mergeWays() int {
+	return int((b.usable() - minBufferSize - b.writer) / (minBufferSize + b.reader))
+}
+
+// runMemory is the memory left for the records of a run while the input and
+// writes tapes are open with ioBuffer buffers.
+func (b memoryBudget) runMemory(writes int) int64 {
+	return b.usable() - int64((writes+1)*b.ioBuffer()) - b.codecs(0, writes)
+}
+
+func clampBuffer(size int64) int {
+	return int(min(max(size, minBufferSize), maxBufferSize))
+}
+
+// recordSize is the memory a record parsed from line takes in a run.
+func recordSize(line string) int64 {
+	return int64(len(line)) + recordOverhead
+}
+
+// newScanner returns a line scanner with a bufSize buffer.
+func newScanner(r io.Reader, bufSize int) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, max(bufSize, maxLineSize)), maxLineSize)
+	return scanner
+}
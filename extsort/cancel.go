@@ -0,0 +1,81 @@
+package extsort
+
+import "context"
+
+// batchRecords is the number of records read or written between two checks
+// for cancellation.
+const batchRecords = 4096
+
+// CanceledError is returned by a sort stopped by its context, either
+// canceled or past its deadline. The temporary files are removed, or kept
+// for Resume if the sort saved a checkpoint.
+type CanceledError struct {
+	// Err is the cause of the context: context.Canceled,
+	// context.DeadlineExceeded or the error it was canceled with, such as
+	// the *MemoryLimitError of a strict MemoryMonitor.
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return "sort canceled: " + e.Err.Error()
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// canceled returns a *CanceledError if ctx is done.
+func canceled(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return &CanceledError{Err: context.Cause(ctx)}
+	}
+	return nil
+}
+
+// batchCheck checks for cancellation once every batchRecords records, and
+// passes the records and comparisons counted on to the progress tracker of
+// the sort. It also carries the order of the sort to the loops that compare
+// records.
+type batchCheck struct {
+	ctx      context.Context
+	progress *progressTracker
+	order    Order
+	n        int
+	bytes    int64
+	compares int64 // counted by the caller
+}
+
+func newBatchCheck(ctx context.Context, st *sortState) *batchCheck {
+	return &batchCheck{ctx: ctx, progress: st.progress, order: st.order}
+}
+
+// record counts a record with the key and a payload of the given length. It
+// returns a *CanceledError if ctx is done at the end of a batch.
+func (b *batchCheck) record(key int64, payload int) error {
+	if b.progress != nil {
+		b.bytes += int64(textSize(key, payload))
+	}
+	return b.next()
+}
+
+// line counts an input line of size bytes, newline included.
+func (b *batchCheck) line(size int) error {
+	b.bytes += int64(size)
+	return b.next()
+}
+
+func (b *batchCheck) next() error {
+	b.n++
+	if b.n < batchRecords {
+		return nil
+	}
+	b.flush()
+	return canceled(b.ctx)
+}
+
+// flush passes on the records and comparisons counted since the last batch.
+func (b *batchCheck) flush() {
+	b.progress.add(b.n, b.bytes)
+	b.progress.compared(b.compares)
+	b.n, b.bytes, b.compares = 0, 0, 0
+}
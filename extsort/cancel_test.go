@@ -0,0 +1,60 @@
+package extsort
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// checkNoTempFiles fails t if the sort left anything in its directory.
+func checkNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("%s left in the temporary directory", e.Name())
+	}
+}
+
+func TestSortCanceled(t *testing.T) {
+	in := duplicateInput(20000, 1000)
+	errStop := errors.New("stop")
+	for _, algorithm := range Algorithms {
+		for _, phase := range []string{PhaseRuns, PhaseMerge} {
+			t.Run(algorithm+"/"+phase, func(t *testing.T) {
+				ctx, cancel := context.WithCancelCause(context.Background())
+				defer cancel(nil)
+				opts := Options{Algorithm: algorithm, ChunkLines: 500, MaxFanIn: 3}
+				opts.TempDirs = []string{t.TempDir()}
+				opts.Progress = func(p Progress) {
+					if p.Phase == phase {
+						cancel(errStop)
+					}
+				}
+				err := Sort(ctx, bytes.NewReader(in), &bytes.Buffer{}, opts)
+				var canceled *CanceledError
+				if !errors.As(err, &canceled) || !errors.Is(err, errStop) {
+					t.Fatalf("Sort = %v, want a CanceledError for %v", err, errStop)
+				}
+				checkNoTempFiles(t, opts.TempDirs[0])
+			})
+		}
+	}
+}
+
+func TestSortDeadline(t *testing.T) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	tmp := t.TempDir()
+	err := Sort(ctx, bytes.NewReader(duplicateInput(20000, 1000)), &bytes.Buffer{}, Options{Config: Config{TempDirs: []string{tmp}}})
+	var canceled *CanceledError
+	if !errors.As(err, &canceled) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Sort = %v, want a CanceledError for %v", err, context.DeadlineExceeded)
+	}
+	checkNoTempFiles(t, tmp)
+}
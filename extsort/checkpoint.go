@@ -0,0 +1,263 @@
+package extsort
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// manifestName is the file of the first job directory that records the
+// progress of a checkpointed sort.
+const manifestName = "manifest.json"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumWriter checksums and counts the bytes written through it.
+type checksumWriter struct {
+	w   io.Writer
+	crc uint32
+	n   int64
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.crc = crc32.Update(c.crc, crcTable, p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// tapeFile is a finished tape recorded in a manifest.
+type tapeFile struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	CRC   uint32 `json:"crc32c"`
+	Runs  int    `json:"runs,omitempty"`  // runs begun on the tape
+	Dummy int    `json:"dummy,omitempty"` // polyphase dummy runs, not on the tape
+	Level int    `json:"level,omitempty"` // merge level of a k-way run
+}
+
+// verify checks that the file still has the size and checksum it was
+// written with.
+func (f tapeFile) verify() error {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", f.Path, err)
+	}
+	defer file.Close()
+
+	sum := checksumWriter{w: io.Discard}
+	if _, err := io.Copy(&sum, bufio.NewReader(file)); err != nil {
+		return fmt.Errorf("failed to read %s: %w", f.Path, err)
+	}
+	if sum.n != f.Size || sum.crc != f.CRC {
+		return fmt.Errorf("%s does not match its checkpoint", f.Path)
+	}
+	return nil
+}
+
+// tapePaths returns the paths of the tapes.
+func tapePaths(tapes []tapeFile) []string {
+	paths := make([]string, len(tapes))
+	for i, t := range tapes {
+		paths[i] = t.Path
+	}
+	return paths
+}
+
+// totalRuns returns the number of runs on all of the tapes.
+func totalRuns(tapes []tapeFile) int {
+	runs := 0
+	for _, t := range tapes {
+		runs += t.Runs
+	}
+	return runs
+}
+
+// manifest is the progress of a checkpointed sort. Stage names the last
+// stage completed, as defined by the algorithm, Step counts the passes or
+// merges done in it, and Tapes hold the data the sort goes on from.
+type manifest struct {
+	Algorithm   string     `json:"algorithm"`
+	Compression string     `json:"compression,omitempty"`
+	Stable      bool       `json:"stable,omitempty"`
+	Descending  bool       `json:"descending,omitempty"`
+	CustomOrder bool       `json:"custom_order,omitempty"` // sorted with an Order.Compare
+	Dirs        []string   `json:"dirs"`
+	Stage       string     `json:"stage"`
+	Step        int        `json:"step"`
+	Tapes       []tapeFile `json:"tapes"`
+}
+
+// checkpoint saves the progress of one sort in its job directories. The
+// zero checkpoint, for a sort that keeps none, saves nothing.
+type checkpoint struct {
+	enabled bool
+	saved   bool
+	m       manifest
+}
+
+func newCheckpoint(enabled bool, algorithm string, c codec, order Order, dirs tempDirs) *checkpoint {
+	return &checkpoint{
+		enabled: enabled,
+		m: manifest{
+			Algorithm:   algorithm,
+			Compression: c.method,
+			Descending:  order.Descending,
+			CustomOrder: order.Compare != nil,
+			Dirs:        dirs,
+		},
+	}
+}
+
+// save records that stage is complete up to step with the given tapes.
+// The manifest is replaced atomically, so a crash leaves the previous one.
+func (c *checkpoint) save(stage string, step int, tapes ...tapeFile) error {
+	if !c.enabled {
+		return nil
+	}
+	c.m.Stage, c.m.Step, c.m.Tapes = stage, step, tapes
+	data, err := json.MarshalIndent(c.m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(c.m.Dirs[0], manifestName)
+	tmp := name + ".tmp"
+	if err := writeSynced(tmp, data); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	c.saved = true
+	return nil
+}
+
+// discard drops the saved progress once the sort is about to overwrite the
+// tapes it holds.
+func (c *checkpoint) discard() error {
+	if !c.saved {
+		return nil
+	}
+	c.saved = false
+	err := os.Remove(filepath.Join(c.m.Dirs[0], manifestName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to discard checkpoint: %w", err)
+	}
+	return nil
+}
+
+func writeSynced(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// finish removes the job directories, unless the sort failed after saving
+// its progress: then they are kept and err is wrapped in a ResumableError.
+func (c *checkpoint) finish(dirs tempDirs, err error) error {
+	if err != nil && c.saved {
+		dirs.keep()
+		return &ResumableError{Job: c.m.Dirs[0], Err: err}
+	}
+	dirs.remove()
+	return err
+}
+
+// ResumableError is returned by a checkpointed sort that failed after saving
+// its progress. Job is the directory to pass to Resume.
+type ResumableError struct {
+	Job string
+	Err error
+}
+
+func (e *ResumableError) Error() string {
+	return fmt.Sprintf("%v (job %s can be resumed)", e.Err, e.Job)
+}
+
+func (e *ResumableError) Unwrap() error {
+	return e.Err
+}
+
+// resumer is a Sorter that can go on from a checkpoint.
+type resumer interface {
+	resume(ctx context.Context, cp *checkpoint, dirs tempDirs, w io.Writer) error
+}
+
+// loadCheckpoint reads the manifest of job and checks its tapes.
+func loadCheckpoint(job string) (*checkpoint, tempDirs, error) {
+	data, err := os.ReadFile(filepath.Join(job, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, fmt.Errorf("job %s has no checkpoint", job)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	cp := &checkpoint{enabled: true, saved: true}
+	if err := json.Unmarshal(data, &cp.m); err != nil {
+		return nil, nil, fmt.Errorf("invalid checkpoint of job %s: %w", job, err)
+	}
+	if len(cp.m.Dirs) == 0 {
+		return nil, nil, fmt.Errorf("invalid checkpoint of job %s: no directories", job)
+	}
+	for _, t := range cp.m.Tapes {
+		if err := t.verify(); err != nil {
+			return nil, nil, err
+		}
+	}
+	dirs, err := claimTempDirs(cp.m.Dirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cp, dirs, nil
+}
+
+// Resume finishes the checkpointed sort of the job directory job, as named
+// by a ResumableError, and writes the sorted records to w. The algorithm,
+// the compression, whether the sort is stable and its direction are those
+// of the job; opts gives the other settings. A job sorted with a custom
+// Order.Compare needs the same function in opts.Order.Compare, which cannot
+// be saved.
+func Resume(ctx context.Context, job string, w io.Writer, opts Options) error {
+	cp, dirs, err := loadCheckpoint(job)
+	if err != nil {
+		return err
+	}
+	opts.Algorithm, opts.Compression, opts.Stable = cp.m.Algorithm, cp.m.Compression, cp.m.Stable
+	opts.Order.Descending = cp.m.Descending
+	opts.Checkpoint = true
+	if cp.m.CustomOrder != (opts.Order.Compare != nil) {
+		dirs.keep()
+		if cp.m.CustomOrder {
+			return fmt.Errorf("job %s was sorted with a custom comparator; set Order.Compare to resume it", job)
+		}
+		return fmt.Errorf("job %s was sorted by key; leave Order.Compare nil to resume it", job)
+	}
+	sorter, err := NewSorter(opts)
+	if err != nil {
+		dirs.keep()
+		return err
+	}
+	r, ok := sorter.(resumer)
+	if !ok {
+		dirs.keep()
+		return fmt.Errorf("algorithm %q cannot resume", cp.m.Algorithm)
+	}
+	return cp.finish(dirs, r.resume(ctx, cp, dirs, w))
+}
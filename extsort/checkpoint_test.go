@@ -0,0 +1,130 @@
+package extsort
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var errWrite = errors.New("disk full")
+
+// failingWriter fails every write, as an output that runs out of space.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+// abandon marks the job directories as left by a process that is gone.
+func abandon(t *testing.T, dirs []string) {
+	t.Helper()
+	for _, job := range dirs {
+		if err := os.WriteFile(filepath.Join(job, ownerFile), []byte("gone"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	in := duplicateInput(20000, 1000)
+	want, err := DigestRecords(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"natural", Options{Algorithm: "natural"}},
+		{"balanced", Options{Algorithm: "balanced", Ways: 3}},
+		{"chunked", Options{Algorithm: "chunked", ChunkLines: 700}},
+		{"kway", Options{Algorithm: "kway", ChunkLines: 500, MaxFanIn: 3}},
+		{"kway descending lz", Options{Algorithm: "kway", ChunkLines: 500, MaxFanIn: 3,
+			Config: Config{Order: Order{Descending: true}, Compression: CompressionLZ}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			tmp := []string{t.TempDir(), t.TempDir()}
+			opts.TempDirs = tmp
+			opts.Checkpoint = true
+			err := Sort(context.Background(), bytes.NewReader(in), failingWriter{}, opts)
+			var resumable *ResumableError
+			if !errors.As(err, &resumable) || !errors.Is(err, errWrite) {
+				t.Fatalf("Sort = %v, want a ResumableError", err)
+			}
+
+			cp, dirs, err := loadCheckpoint(resumable.Job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dirs.keep()
+			if len(cp.m.Dirs) != len(tmp) {
+				t.Fatalf("checkpoint holds directories %v, want one in each of %v", cp.m.Dirs, tmp)
+			}
+			abandon(t, cp.m.Dirs)
+
+			// Cleanup spares every directory of the job until asked to
+			// remove resumable ones.
+			if removed, err := RemoveOrphans(tmp, false, false); err != nil || len(removed) > 0 {
+				t.Fatalf("RemoveOrphans removed %v, %v", removed, err)
+			}
+			orphans, err := RemoveOrphans(tmp, true, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(orphans)
+			if jobs := slices.Sorted(slices.Values(cp.m.Dirs)); !slices.Equal(orphans, jobs) {
+				t.Fatalf("resumable orphans %v, want %v", orphans, jobs)
+			}
+
+			var out bytes.Buffer
+			if err := Resume(context.Background(), resumable.Job, &out, Options{Config: Config{TempDirs: tmp}}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := opts.Order.Verify(bytes.NewReader(out.Bytes()), &want); err != nil {
+				t.Fatal(err)
+			}
+			for _, job := range cp.m.Dirs {
+				if _, err := os.Stat(job); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("job directory %s left after the resumed sort: %v", job, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckpointRelativeTempDir(t *testing.T) {
+	// The job is saved with absolute paths, so it resumes from another
+	// working directory.
+	in := duplicateInput(5000, 100)
+	want, err := DigestRecords(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Algorithm: "natural", Config: Config{TempDirs: []string{"tmp"}, Checkpoint: true}}
+	err = Sort(context.Background(), bytes.NewReader(in), failingWriter{}, opts)
+	var resumable *ResumableError
+	if !errors.As(err, &resumable) {
+		t.Fatalf("Sort = %v, want a ResumableError", err)
+	}
+	if !filepath.IsAbs(resumable.Job) {
+		t.Fatalf("job %s is not an absolute path", resumable.Job)
+	}
+
+	t.Chdir(t.TempDir())
+	var out bytes.Buffer
+	if err := Resume(context.Background(), resumable.Job, &out, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(bytes.NewReader(out.Bytes()), &want); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,112 @@
+package extsort
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// ChunkedMerge is the natural merge sort with a presorting pass: the first
+// distribution builds runs in memory, so the natural merge starts from long
+// runs instead of the ones found in the input.
+type ChunkedMerge struct {
+	Config
+	// ChunkLines caps the number of records kept in memory while building
+	// runs. Zero leaves only the memory budget as the limit.
+	ChunkLines int
+	// RunGeneration is RunsSorted (the default) or RunsReplacement.
+	RunGeneration string
+	// AdaptiveRuns shrinks the runs built in memory while the garbage
+	// collector is under pressure and grows them back, up to the memory
+	// budget, once it is not.
+	AdaptiveRuns bool
+	// Stable keeps records with equal keys in their input order. The merge
+	// passes always do; Stable makes the runs built in memory do as well.
+	Stable bool
+}
+
+func (s ChunkedMerge) Sort(ctx context.Context, r io.Reader, w io.Writer) (err error) {
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+	budget := newMemoryBudget(s.MemoryLimit, c)
+	dirs, err := newTempDirs(s.TempDirs)
+	if err != nil {
+		return err
+	}
+	cp := newCheckpoint(s.Checkpoint, "chunked", c, s.Order, dirs)
+	cp.m.Stable = s.Stable
+	progress := newProgress("chunked", s.Progress, s.Stats, r, naturalSweeps)
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	defer func() {
+		err = cp.finish(dirs, err)
+		progress.finish(err)
+	}()
+	tapes := newTapeSet(dirs, budget, c)
+	progress.phase(PhaseRuns, 0, 0, false)
+
+	// The input and the two tapes are open while runs are built.
+	size := runSize{lines: s.ChunkLines, bytes: budget.runMemory(2)}.adaptive(s.AdaptiveRuns)
+	dist, err := distributeChunks(ctx, st, r, tapes, s.RunGeneration, s.Stable, size, budget.ioBuffer())
+	if err != nil {
+		return fmt.Errorf("failed to distribute chunks: %w", err)
+	}
+	if err := cp.save(stageDistributed, 0, dist...); err != nil {
+		return err
+	}
+	return mergePasses(ctx, st, dist[0].Runs, dist[1].Runs, 1, w, tapes, cp)
+}
+
+func (s ChunkedMerge) resume(ctx context.Context, cp *checkpoint, dirs tempDirs, w io.Writer) (err error) {
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+	progress := newProgress("chunked", s.Progress, s.Stats, nil, naturalSweeps)
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	c.disk.reopened(cp.m.Tapes...)
+	defer func() { progress.finish(err) }()
+	return resumePasses(ctx, st, cp, w, newTapeSet(dirs, newMemoryBudget(s.MemoryLimit, c), c))
+}
+
+// distributeChunks splits the records of r into runs that fit size and writes
+// them to the B and C tapes in turn, starting with B. It returns both tapes
+// with their run counts.
+func distributeChunks(ctx context.Context, st *sortState, r io.Reader, tapes tapeSet, method string, stable bool, size runSize, bufSize int) ([]tapeFile, error) {
+	outB, err := createTape(tapes.b, bufSize, tapes.codec)
+	if err != nil {
+		return nil, err
+	}
+	defer outB.Close()
+
+	outC, err := createTape(tapes.c, bufSize, tapes.codec)
+	if err != nil {
+		return nil, err
+	}
+	defer outC.Close()
+
+	currOutput := outC
+	next := func() (*tapeWriter, error) {
+		if currOutput == outB {
+			currOutput = outC
+		} else {
+			currOutput = outB
+		}
+		currOutput.beginRun()
+		return currOutput, nil
+	}
+	if err := generateRuns(ctx, st, r, method, stable, size, bufSize, next); err != nil {
+		return nil, err
+	}
+
+	if err := outB.Close(); err != nil {
+		return nil, err
+	}
+	if err := outC.Close(); err != nil {
+		return nil, err
+	}
+	return []tapeFile{outB.tapeFile(), outC.tapeFile()}, nil
+}
@@ -0,0 +1,200 @@
+package extsort
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Compression methods of the temporary runs accepted by Options.Compression.
+const (
+	// CompressionNone writes the runs as they are.
+	CompressionNone = "none"
+	// CompressionGzip compresses the runs with gzip at its fastest level.
+	CompressionGzip = "gzip"
+	// CompressionLZ compresses the runs in blocks with a simple LZ77 codec,
+	// which saves less space than gzip but costs far less time.
+	CompressionLZ = "lz"
+)
+
+// codecBuffer is the buffer between a compressor and its file.
+const codecBuffer = 64 << 10
+
+// The memory a compressed tape holds besides its own buffer: the codec
+// buffer and the state of the codec.
+const (
+	lzReaderMemory   = codecBuffer + 2*lzBlockSize    // block and encoding
+	lzWriterMemory   = lzReaderMemory + 4<<lzHashBits // and the hash table
+	gzipReaderMemory = codecBuffer + 64<<10           // window and tables
+	gzipWriterMemory = codecBuffer + 800<<10          // compressor at BestSpeed
+)
+
+// CompressionStats sums up the compression of the temporary runs of a sort.
+// A sort updates it as tapes are closed, from several goroutines at once.
+type CompressionStats struct {
+	mu sync.Mutex
+	// RawBytes is the size of the runs written before compression.
+	RawBytes int64
+	// CompressedBytes is the size of the runs written after compression.
+	CompressedBytes int64
+	// CompressTime and DecompressTime are the time spent in the codec.
+	CompressTime   time.Duration
+	DecompressTime time.Duration
+}
+
+// Ratio returns RawBytes divided by CompressedBytes, or 1 if nothing was written.
+func (s *CompressionStats) Ratio() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.CompressedBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.CompressedBytes)
+}
+
+func (s *CompressionStats) add(raw, compressed int64, compress, decompress time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.RawBytes += raw
+	s.CompressedBytes += compressed
+	s.CompressTime += compress
+	s.DecompressTime += decompress
+}
+
+// codec is the compression of the tapes of a sort.
+type codec struct {
+	method string
+	stats  *CompressionStats
+	disk   *diskUsage // counts the tape I/O if the sort collects Stats
+}
+
+func newCodec(method string, stats *CompressionStats) (codec, error) {
+	switch method {
+	case "", CompressionNone:
+		return codec{stats: stats}, nil
+	case CompressionGzip, CompressionLZ:
+		return codec{method: method, stats: stats}, nil
+	default:
+		return codec{}, fmt.Errorf("unknown compression %q", method)
+	}
+}
+
+// memory returns the memory held by the codec of a tape being read and of
+// one being written.
+func (c codec) memory() (reader, writer int64) {
+	switch c.method {
+	case CompressionGzip:
+		return gzipReaderMemory, gzipWriterMemory
+	case CompressionLZ:
+		return lzReaderMemory, lzWriterMemory
+	}
+	return 0, 0
+}
+
+// newWriter returns the writer that compresses into w, or nil if the runs
+// are not compressed.
+func (c codec) newWriter(w io.Writer) *codecWriter {
+	if c.method == "" {
+		return nil
+	}
+	cw := &codecWriter{file: bufio.NewWriterSize(w, codecBuffer), stats: c.stats}
+	cw.counter.w = cw.file
+	switch c.method {
+	case CompressionGzip:
+		// The level is valid, so there is no error.
+		cw.zw, _ = gzip.NewWriterLevel(&cw.counter, gzip.BestSpeed)
+	case CompressionLZ:
+		cw.zw = newLZWriter(&cw.counter)
+	}
+	return cw
+}
+
+// newReader returns the reader that decompresses r, or nil if the runs are
+// not compressed.
+func (c codec) newReader(r io.Reader) (*codecReader, error) {
+	if c.method == "" {
+		return nil, nil
+	}
+	cr := &codecReader{stats: c.stats}
+	file := bufio.NewReaderSize(r, codecBuffer)
+	switch c.method {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tape: %w", err)
+		}
+		cr.zr = zr
+	case CompressionLZ:
+		cr.zr = newLZReader(file)
+	}
+	return cr, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// codecWriter compresses a tape and times the compressor.
+type codecWriter struct {
+	zw      io.WriteCloser
+	counter countingWriter
+	file    *bufio.Writer
+	raw     int64
+	elapsed time.Duration
+	stats   *CompressionStats
+}
+
+func (c *codecWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := c.zw.Write(p)
+	c.elapsed += time.Since(start)
+	c.raw += int64(n)
+	return n, err
+}
+
+// Close flushes the compressor and its buffer, but leaves the file open.
+func (c *codecWriter) Close() error {
+	start := time.Now()
+	err := c.zw.Close()
+	c.elapsed += time.Since(start)
+	if err == nil {
+		err = c.file.Flush()
+	}
+	c.stats.add(c.raw, c.counter.n, c.elapsed, 0)
+	return err
+}
+
+// codecReader decompresses a tape and times the decompressor.
+type codecReader struct {
+	zr      io.Reader
+	elapsed time.Duration
+	stats   *CompressionStats
+}
+
+func (c *codecReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := c.zr.Read(p)
+	c.elapsed += time.Since(start)
+	return n, err
+}
+
+// Close reports the time spent. It does not close the file.
+func (c *codecReader) Close() error {
+	c.stats.add(0, 0, 0, c.elapsed)
+	c.elapsed = 0
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package extsort
+
+// openFileLimit returns the number of files the process may have open.
+func openFileLimit() int {
+	return 512
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package extsort
+
+import "syscall"
+
+// openFileLimit returns the number of files the process may have open.
+func openFileLimit() int {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil || rlim.Cur > 1<<20 {
+		return 1 << 20
+	}
+	return int(rlim.Cur)
+}
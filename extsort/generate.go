@@ -0,0 +1,68 @@
+package extsort
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+const (
+	charSet  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%^&*()_+-={}|;:,.<>?"
+	wordSize = 20
+)
+
+func generateRandomWord(size int) string {
+	var builder strings.Builder
+	builder.Grow(size)
+	for range size {
+		builder.WriteByte(charSet[rand.Intn(len(charSet))])
+	}
+	return builder.String()
+}
+
+func generateRandomDate() string {
+	year := rand.Intn(2024-1970+1) + 1970
+	month := rand.Intn(12) + 1
+	var maxDay int
+	switch month {
+	case 4, 6, 9, 11:
+		maxDay = 30
+	case 2:
+		maxDay = 28
+	default:
+		maxDay = 31
+	}
+	day := rand.Intn(maxDay) + 1
+	return fmt.Sprintf("%02d/%02d/%04d", day, month, year)
+}
+
+// RandomRecord returns a record with a key in [0, keySize) and a random word and date.
+func RandomRecord(keySize int) Record {
+	return Record{
+		Key:  rand.Int63n(int64(keySize)),
+		Word: generateRandomWord(wordSize),
+		Date: generateRandomDate(),
+	}
+}
+
+// GenerateFile writes lines random records with keys in [0, keySize) to path.
+func GenerateFile(path string, lines, keySize int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for range lines {
+		if _, err := writer.WriteString(RandomRecord(keySize).String() + "\n"); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return file.Close()
+}
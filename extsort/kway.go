@@ -0,0 +1,311 @@
+package extsort
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"slices"
+	"sync"
+)
+
+// KWayMerge splits the input into sorted chunk files built in memory and
+// merges them through a loser tree, all at once when the open file limit and
+// the memory budget allow and in several levels otherwise.
+type KWayMerge struct {
+	Config
+	// ChunkLines caps the number of records kept in memory while building
+	// runs. Zero leaves only the memory budget as the limit.
+	ChunkLines int
+	// RunGeneration is RunsSorted (the default) or RunsReplacement.
+	RunGeneration string
+	// AdaptiveRuns shrinks the runs built in memory while the garbage
+	// collector is under pressure and grows them back, up to the memory
+	// budget, once it is not.
+	AdaptiveRuns bool
+	// Stable keeps records with equal keys in their input order: the chunks
+	// are sorted stably and the merge levels merge adjacent runs only.
+	Stable bool
+	// MaxFanIn caps the number of runs merged at once. The fan-in is also
+	// limited by the open file limit and the memory budget; when there are
+	// more runs, they are merged in several levels.
+	MaxFanIn int
+	// Workers is the number of chunks sorted and written concurrently with
+	// reading the input. Zero selects GOMAXPROCS. Replacement selection
+	// always builds its runs on one goroutine.
+	Workers int
+}
+
+func (s KWayMerge) Sort(ctx context.Context, r io.Reader, w io.Writer) (err error) {
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+	dirs, err := newTempDirs(s.TempDirs)
+	if err != nil {
+		return err
+	}
+	cp := newCheckpoint(s.Checkpoint, "kway", c, s.Order, dirs)
+	cp.m.Stable = s.Stable
+	budget := newMemoryBudget(s.MemoryLimit, c)
+	progress := newProgress("kway", s.Progress, s.Stats, r, s.sweeps(budget))
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	defer func() {
+		err = cp.finish(dirs, err)
+		progress.finish(err)
+	}()
+	progress.phase(PhaseRuns, 0, 0, false)
+
+	runs, err := s.writeChunks(ctx, st, r, dirs, budget, c)
+	if err != nil {
+		return fmt.Errorf("failed to write chunks: %w", err)
+	}
+	if err := cp.save("chunks", 0, runs...); err != nil {
+		return err
+	}
+	return s.merge(ctx, st, runs, 0, w, dirs, budget, c, cp)
+}
+
+// resume goes on with the merge levels after the last one saved.
+func (s KWayMerge) resume(ctx context.Context, cp *checkpoint, dirs tempDirs, w io.Writer) (err error) {
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+	budget := newMemoryBudget(s.MemoryLimit, c)
+	progress := newProgress("kway", s.Progress, s.Stats, nil, s.sweeps(budget))
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	c.disk.reopened(cp.m.Tapes...)
+	defer func() { progress.finish(err) }()
+	return s.merge(ctx, st, cp.m.Tapes, cp.m.Step, w, dirs, budget, c, cp)
+}
+
+// sweeps estimates the sweeps of the merge levels.
+func (s KWayMerge) sweeps(budget memoryBudget) sweepFunc {
+	fanIn := s.maxFanIn(budget)
+	return func(runs int) int { return mergeSweeps(runs, fanIn) }
+}
+
+// merge merges the runs into w, after merged intermediate merges are done.
+func (s KWayMerge) merge(ctx context.Context, st *sortState, runs []tapeFile, merged int, w io.Writer, dirs tempDirs, budget memoryBudget, c codec, cp *checkpoint) error {
+	runs, merged, err := s.mergeLevels(ctx, st, runs, merged, dirs, budget, c, cp)
+	if err != nil {
+		return fmt.Errorf("failed to merge chunks: %w", err)
+	}
+	st.progress.phase(PhaseMerge, mergeLevel(runs), len(runs), true)
+	bufSize := budget.mergeBuffer(len(runs), 1)
+	out := newOutputWriter(w, bufSize)
+	if err := mergeChunks(ctx, st, tapePaths(runs), out, bufSize, c); err != nil {
+		return fmt.Errorf("failed to merge chunks: %w", err)
+	}
+	return out.Close()
+}
+
+// reservedFiles is how many open files are kept for everything but the runs
+// being merged: the standard streams, the input, the output and the runtime.
+const reservedFiles = 16
+
+// maxFanIn is the largest number of runs merged at once. Every run takes an
+// open file, a buffer of at least minBufferSize and its codec, if any.
+func (s KWayMerge) maxFanIn(budget memoryBudget) int {
+	fanIn := min(openFileLimit()-reservedFiles, budget.mergeWays())
+	if s.MaxFanIn > 0 {
+		fanIn = min(fanIn, s.MaxFanIn)
+	}
+	return max(fanIn, 2)
+}
+
+// mergeLevels merges runs into intermediate runs until no more than the
+// maximum fan-in are left for the final merge, and returns them. It follows
+// the k-ary Huffman tree: the oldest, smallest runs are merged first, and the
+// first merge takes just enough runs for every later one to be a full merge.
+// A stable sort keeps the runs in input order instead, so it merges the
+// adjacent runs that are smallest together and puts the result in their
+// place. The runs merged are removed right away, once the checkpoint no longer
+// needs them. merged is the number of merges already done; the total is
+// returned with the runs left.
+func (s KWayMerge) mergeLevels(ctx context.Context, st *sortState, runs []tapeFile, merged int, dirs tempDirs, budget memoryBudget, c codec, cp *checkpoint) ([]tapeFile, int, error) {
+	fanIn := s.maxFanIn(budget)
+	for ; len(runs) > fanIn; merged++ {
+		if err := canceled(ctx); err != nil {
+			return runs, merged, err
+		}
+		n := fanIn
+		if merged == 0 {
+			n = (len(runs)-2)%(fanIn-1) + 2
+		}
+		first := 0
+		if s.Stable {
+			first = smallestAdjacent(runs, n)
+		}
+		level := mergeLevel(runs[first : first+n])
+		st.progress.phase(PhaseMerge, level, len(runs), false)
+
+		inputs := tapePaths(runs[first : first+n])
+		name := dirs.path(merged, fmt.Sprintf("merge_%d.tmp", merged))
+		run, err := mergeRunFiles(ctx, st, inputs, name, budget.mergeBuffer(n, 1), c)
+		if err != nil {
+			cleanupTempFiles(name)
+			return runs, merged, err
+		}
+		run.Level = level
+		if s.Stable {
+			runs = slices.Replace(runs, first, first+n, run)
+		} else {
+			runs = append(runs[n:], run)
+		}
+		if err := cp.save("levels", merged+1, runs...); err != nil {
+			return runs, merged, err
+		}
+		cleanupTempFiles(inputs...)
+		c.disk.removed(inputs...)
+	}
+	return runs, merged, nil
+}
+
+// mergeLevel returns the level of the run merged from runs, which numbers
+// the merge pass it is written in: one more than the highest level of runs,
+// where the runs built from the input are at level 0.
+func mergeLevel(runs []tapeFile) int {
+	level := 0
+	for _, t := range runs {
+		level = max(level, t.Level)
+	}
+	return level + 1
+}
+
+// smallestAdjacent returns the first of the n adjacent runs with the
+// smallest total size.
+func smallestAdjacent(runs []tapeFile, n int) int {
+	var size int64
+	for _, t := range runs[:n] {
+		size += t.Size
+	}
+	first, smallest := 0, size
+	for i := n; i < len(runs); i++ {
+		size += runs[i].Size - runs[i-n].Size
+		if size < smallest {
+			first, smallest = i-n+1, size
+		}
+	}
+	return first
+}
+
+func mergeRunFiles(ctx context.Context, st *sortState, inputs []string, name string, bufSize int, c codec) (tapeFile, error) {
+	out, err := createTape(name, bufSize, c)
+	if err != nil {
+		return tapeFile{}, err
+	}
+	if err := mergeChunks(ctx, st, inputs, out, bufSize, c); err != nil {
+		out.Close()
+		return tapeFile{}, err
+	}
+	if err := out.Close(); err != nil {
+		return tapeFile{}, err
+	}
+	return out.tapeFile(), nil
+}
+
+// writeChunks splits the records of r into sorted chunk files and returns them.
+func (s KWayMerge) writeChunks(ctx context.Context, st *sortState, r io.Reader, dirs tempDirs, budget memoryBudget, c codec) ([]tapeFile, error) {
+	workers := s.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	// Every worker holds a chunk; don't let them shrink below a file buffer.
+	for workers > 1 && budget.runMemory(workers)/int64(workers+1) < int64(budget.ioBuffer()) {
+		workers--
+	}
+	if workers > 1 && s.RunGeneration != RunsReplacement {
+		return s.writeChunksParallel(ctx, st, r, dirs, budget, workers, c)
+	}
+
+	var chunks []tapeFile
+	var out *tapeWriter
+	next := func() (*tapeWriter, error) {
+		if out != nil {
+			if err := out.Close(); err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, out.tapeFile())
+		}
+		tmpName := dirs.path(len(chunks), fmt.Sprintf("chunk_%d.tmp", len(chunks)))
+		var err error
+		if out, err = createTape(tmpName, budget.ioBuffer(), c); err != nil {
+			return nil, err
+		}
+		out.beginRun()
+		return out, nil
+	}
+
+	// The input and the current chunk file are open while runs are built.
+	size := runSize{lines: s.ChunkLines, bytes: budget.runMemory(1)}.adaptive(s.AdaptiveRuns)
+	err := generateRuns(ctx, st, r, s.RunGeneration, s.Stable, size, budget.ioBuffer(), next)
+	if out != nil {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		chunks = append(chunks, out.tapeFile())
+	}
+	return chunks, err
+}
+
+// writeChunksParallel is writeChunks with the chunks sorted and written by
+// workers goroutines. The run memory is split between the chunk being read
+// and the ones being sorted.
+func (s KWayMerge) writeChunksParallel(ctx context.Context, st *sortState, r io.Reader, dirs tempDirs, budget memoryBudget, workers int, c codec) ([]tapeFile, error) {
+	// The writers are kept to describe the chunks once the workers have
+	// closed them.
+	var mu sync.Mutex
+	var writers []*tapeWriter
+	create := func(index int) (*tapeWriter, error) {
+		out, err := createTape(dirs.path(index, fmt.Sprintf("chunk_%d.tmp", index)), budget.ioBuffer(), c)
+		if err != nil {
+			return nil, err
+		}
+		out.beginRun()
+		mu.Lock()
+		if index >= len(writers) {
+			writers = append(writers, make([]*tapeWriter, index+1-len(writers))...)
+		}
+		writers[index] = out
+		mu.Unlock()
+		return out, nil
+	}
+
+	// The input and a chunk file per worker are open while runs are built.
+	size := runSize{
+		lines: s.ChunkLines,
+		bytes: budget.runMemory(workers) / int64(workers+1),
+	}.adaptive(s.AdaptiveRuns)
+	runs, err := generateSortedRunsParallel(ctx, st, r, s.Stable, size, budget.ioBuffer(), workers, create)
+
+	if err != nil {
+		return nil, err
+	}
+	chunks := make([]tapeFile, runs)
+	for i := range chunks {
+		chunks[i] = writers[i].tapeFile()
+	}
+	return chunks, nil
+}
+
+// mergeChunks merges the sorted chunk files into writer.
+func mergeChunks(ctx context.Context, st *sortState, tempFiles []string, writer *tapeWriter, bufSize int, c codec) error {
+	readers := make([]*runReader, 0, len(tempFiles))
+	for _, fname := range tempFiles {
+		r, err := openTape(fname, bufSize, false, c)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if r.inRun {
+			readers = append(readers, r)
+		}
+	}
+	check := newBatchCheck(ctx, st)
+	defer check.flush()
+	return mergeReaders(check, writer, readers)
+}
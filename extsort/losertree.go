@@ -0,0 +1,97 @@
+package extsort
+
+// LoserTree repeatedly selects the smallest of the current items of k
+// sources, as in a k-way merge. Each internal node keeps the loser of the
+// match played there and the overall winner is kept apart, so replacing the
+// winner costs one comparison per level on the path to the root and no
+// allocations. Equal items are won by the source with the lower index.
+type LoserTree[T any] struct {
+	items []T
+	done  []bool
+	nodes []int // nodes[0] is the winner, nodes[1:] the losers
+	less  func(a, b T) bool
+	live  int
+}
+
+// NewLoserTree builds a tree over the current items of len(items) sources.
+func NewLoserTree[T any](items []T, less func(a, b T) bool) *LoserTree[T] {
+	k := len(items)
+	t := &LoserTree[T]{
+		items: items,
+		done:  make([]bool, k),
+		nodes: make([]int, max(k, 1)),
+		less:  less,
+		live:  k,
+	}
+	if k == 0 {
+		return t
+	}
+
+	// Leaf i sits at position k+i; play the matches bottom-up.
+	winners := make([]int, 2*k)
+	for i := range k {
+		winners[k+i] = i
+	}
+	for n := k - 1; n > 0; n-- {
+		a, b := winners[2*n], winners[2*n+1]
+		if t.beats(b, a) {
+			a, b = b, a
+		}
+		winners[n], t.nodes[n] = a, b
+	}
+	t.nodes[0] = winners[1]
+	return t
+}
+
+// beats reports whether source a wins against source b.
+func (t *LoserTree[T]) beats(a, b int) bool {
+	if t.done[a] || t.done[b] {
+		return !t.done[a]
+	}
+	// One comparison settles the match: a tie goes to the lower index.
+	if a < b {
+		return !t.less(t.items[b], t.items[a])
+	}
+	return t.less(t.items[a], t.items[b])
+}
+
+// Len returns the number of sources not yet removed.
+func (t *LoserTree[T]) Len() int {
+	return t.live
+}
+
+// Winner returns the index and the item of the source with the smallest item.
+// It must not be called when Len is zero.
+func (t *LoserTree[T]) Winner() (int, T) {
+	i := t.nodes[0]
+	return i, t.items[i]
+}
+
+// Replace sets the next item of the winning source.
+func (t *LoserTree[T]) Replace(item T) {
+	t.items[t.nodes[0]] = item
+	t.replay()
+}
+
+// Fix restores the order after the item of the winning source changed in place.
+func (t *LoserTree[T]) Fix() {
+	t.replay()
+}
+
+// Remove drops the winning source, which has no items left.
+func (t *LoserTree[T]) Remove() {
+	t.done[t.nodes[0]] = true
+	t.live--
+	t.replay()
+}
+
+// replay plays the winner's new item against the losers on its path to the root.
+func (t *LoserTree[T]) replay() {
+	winner := t.nodes[0]
+	for n := (len(t.items) + winner) / 2; n > 0; n /= 2 {
+		if t.beats(t.nodes[n], winner) {
+			t.nodes[n], winner = winner, t.nodes[n]
+		}
+	}
+	t.nodes[0] = winner
+}
@@ -0,0 +1,192 @@
+package extsort
+
+import (
+	"container/heap"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// mergeSource is a sorted run being merged in memory.
+type mergeSource struct {
+	keys []int64
+	pos  int
+}
+
+func sourceLess(a, b *mergeSource) bool {
+	return a.keys[a.pos] < b.keys[b.pos]
+}
+
+// newSources returns a source for every run that is not empty.
+func newSources(runs [][]int64) []*mergeSource {
+	var sources []*mergeSource
+	for _, keys := range runs {
+		if len(keys) > 0 {
+			sources = append(sources, &mergeSource{keys: keys})
+		}
+	}
+	return sources
+}
+
+func mergeLoserTree(runs [][]int64, emit func(int64)) {
+	tree := NewLoserTree(newSources(runs), sourceLess)
+	for tree.Len() > 0 {
+		_, s := tree.Winner()
+		emit(s.keys[s.pos])
+		s.pos++
+		if s.pos < len(s.keys) {
+			tree.Fix()
+		} else {
+			tree.Remove()
+		}
+	}
+}
+
+// fileRecord and minHeap are the container/heap merge thirdAlgo used before
+// the loser tree: every record is boxed into an interface{} on Push.
+type fileRecord struct {
+	key  int64
+	file int
+}
+
+type minHeap []fileRecord
+
+func (h minHeap) Len() int            { return len(h) }
+func (h minHeap) Less(i, j int) bool  { return h[i].key < h[j].key }
+func (h minHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *minHeap) Push(x interface{}) { *h = append(*h, x.(fileRecord)) }
+func (h *minHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+func mergeHeap(runs [][]int64, emit func(int64)) {
+	sources := newSources(runs)
+	h := &minHeap{}
+	for i, s := range sources {
+		heap.Push(h, fileRecord{key: s.keys[0], file: i})
+	}
+	for h.Len() > 0 {
+		fr := heap.Pop(h).(fileRecord)
+		emit(fr.key)
+		s := sources[fr.file]
+		s.pos++
+		if s.pos < len(s.keys) {
+			heap.Push(h, fileRecord{key: s.keys[s.pos], file: fr.file})
+		}
+	}
+}
+
+// sortedRuns deals records random keys below keys into ways sorted runs.
+func sortedRuns(records, ways int, keys int64) [][]int64 {
+	rng := rand.New(rand.NewSource(1))
+	runs := make([][]int64, ways)
+	for i := range records {
+		runs[i%ways] = append(runs[i%ways], rng.Int63n(keys))
+	}
+	for _, run := range runs {
+		slices.Sort(run)
+	}
+	return runs
+}
+
+func TestLoserTreeMerge(t *testing.T) {
+	for _, tc := range []struct{ records, ways int }{
+		{0, 0}, {0, 4}, {1, 1}, {5, 8}, {1000, 1}, {1000, 7}, {1000, 64},
+	} {
+		runs := sortedRuns(tc.records, tc.ways, 100)
+		want := slices.Concat(runs...)
+		slices.Sort(want)
+		var got []int64
+		mergeLoserTree(runs, func(key int64) { got = append(got, key) })
+		if !slices.Equal(got, want) {
+			t.Errorf("%d records in %d ways: merged %v, want %v", tc.records, tc.ways, got, want)
+		}
+	}
+}
+
+func TestLoserTreeTies(t *testing.T) {
+	// Every source holds the same keys; equal keys must come from the
+	// source with the lower index first.
+	type item struct{ key, source int }
+	const sources, keys = 5, 4
+	items := make([]item, sources)
+	for i := range items {
+		items[i] = item{0, i}
+	}
+	tree := NewLoserTree(items, func(a, b item) bool { return a.key < b.key })
+	var got []item
+	for tree.Len() > 0 {
+		_, it := tree.Winner()
+		got = append(got, it)
+		if it.key+1 < keys {
+			tree.Replace(item{it.key + 1, it.source})
+		} else {
+			tree.Remove()
+		}
+	}
+	for i, it := range got {
+		if want := (item{i / sources, i % sources}); it != want {
+			t.Fatalf("item %d is %v, want %v", i, it, want)
+		}
+	}
+}
+
+func TestLoserTreeComparisons(t *testing.T) {
+	// Replacing the winner plays one match per level, each a single
+	// comparison, whether the keys are distinct or mostly equal.
+	const records = 10000
+	for _, ways := range []int{2, 7, 64, 100} {
+		for _, keys := range []int64{1 << 62, 10} {
+			runs := sortedRuns(records, ways, keys)
+			calls := 0
+			tree := NewLoserTree(newSources(runs), func(a, b *mergeSource) bool {
+				calls++
+				return sourceLess(a, b)
+			})
+			calls = 0
+			for tree.Len() > 0 {
+				_, s := tree.Winner()
+				s.pos++
+				if s.pos < len(s.keys) {
+					tree.Fix()
+				} else {
+					tree.Remove()
+				}
+			}
+			levels := bits.Len(uint(ways - 1))
+			if calls > records*levels {
+				t.Errorf("%d ways, keys below %d: %.2f comparisons per record, want at most %d",
+					ways, keys, float64(calls)/records, levels)
+			}
+		}
+	}
+}
+
+func benchmarkMerge(b *testing.B, merge func([][]int64, func(int64))) {
+	const records = 1 << 20
+	for _, ways := range []int{2, 8, 64, 512} {
+		runs := sortedRuns(records, ways, 1<<62)
+		b.Run(fmt.Sprintf("ways=%d", ways), func(b *testing.B) {
+			b.ReportAllocs()
+			var sum int64
+			for b.Loop() {
+				merge(runs, func(key int64) { sum += key })
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*records), "ns/record")
+		})
+	}
+}
+
+func BenchmarkHeapMerge(b *testing.B) {
+	benchmarkMerge(b, mergeHeap)
+}
+
+func BenchmarkLoserTree(b *testing.B) {
+	benchmarkMerge(b, mergeLoserTree)
+}
@@ -0,0 +1,256 @@
+package extsort
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// The LZ codec compresses blocks of up to lzBlockSize bytes independently.
+// A block is written as the uvarint length of its data and the uvarint
+// length of its encoding, zero when the data is stored as it is, followed by
+// the encoding. The encoding is a list of sequences, each a uvarint literal
+// length and the literals, then, unless the block ends there, a uvarint
+// offset back into the block and the uvarint length of the match minus
+// lzMinMatch.
+const (
+	lzBlockSize = 64 << 10
+	lzMinMatch  = 4
+	lzHashBits  = 14
+)
+
+var errCorruptLZ = errors.New("corrupt lz block")
+
+// lzWriter compresses the data written to it into w.
+type lzWriter struct {
+	w     io.Writer
+	block []byte
+	enc   []byte
+	table [1 << lzHashBits]int32 // last position+1 of every hash in the block
+}
+
+func newLZWriter(w io.Writer) *lzWriter {
+	return &lzWriter{
+		w:     w,
+		block: make([]byte, 0, lzBlockSize),
+		enc:   make([]byte, 0, lzBlockSize+2*binary.MaxVarintLen64),
+	}
+}
+
+func (z *lzWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), lzBlockSize-len(z.block))
+		z.block = append(z.block, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(z.block) == lzBlockSize {
+			if err := z.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the last, partial block. It does not close w.
+func (z *lzWriter) Close() error {
+	if len(z.block) == 0 {
+		return nil
+	}
+	return z.flush()
+}
+
+func (z *lzWriter) flush() error {
+	encoded := z.encode()
+	var buf [2 * binary.MaxVarintLen64]byte
+	header := binary.AppendUvarint(buf[:0], uint64(len(z.block)))
+	data := z.block
+	if encoded < len(z.block) {
+		header = binary.AppendUvarint(header, uint64(encoded))
+		data = z.enc[:encoded]
+	} else {
+		header = binary.AppendUvarint(header, 0)
+	}
+	if _, err := z.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := z.w.Write(data); err != nil {
+		return err
+	}
+	z.block = z.block[:0]
+	return nil
+}
+
+func lzHash(v uint32) uint32 {
+	return (v * 2654435761) >> (32 - lzHashBits)
+}
+
+// encode compresses the block into z.enc and returns the length of the
+// encoding. It gives up once the encoding is no shorter than the block.
+func (z *lzWriter) encode() int {
+	clear(z.table[:])
+	src := z.block
+	dst := z.enc[:0]
+	limit := len(src) - 2*binary.MaxVarintLen64
+
+	anchor := 0
+	for i := 0; i+lzMinMatch <= len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := lzHash(v)
+		candidate := int(z.table[h]) - 1
+		z.table[h] = int32(i + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != v {
+			// Skip faster through data that does not compress.
+			i += 1 + (i-anchor)>>5
+			continue
+		}
+
+		length := lzMinMatch
+		for i+length+8 <= len(src) {
+			x := binary.LittleEndian.Uint64(src[i+length:]) ^ binary.LittleEndian.Uint64(src[candidate+length:])
+			if x != 0 {
+				length += bits.TrailingZeros64(x) / 8
+				break
+			}
+			length += 8
+		}
+		if i+length+8 > len(src) {
+			for i+length < len(src) && src[i+length] == src[candidate+length] {
+				length++
+			}
+		}
+
+		if len(dst)+i-anchor > limit {
+			return len(src)
+		}
+		dst = binary.AppendUvarint(dst, uint64(i-anchor))
+		dst = append(dst, src[anchor:i]...)
+		dst = binary.AppendUvarint(dst, uint64(i-candidate))
+		dst = binary.AppendUvarint(dst, uint64(length-lzMinMatch))
+		i += length
+		anchor = i
+	}
+	if len(dst)+len(src)-anchor > limit {
+		return len(src)
+	}
+	// A block that ends with a match has no last literals.
+	if anchor < len(src) {
+		dst = binary.AppendUvarint(dst, uint64(len(src)-anchor))
+		dst = append(dst, src[anchor:]...)
+	}
+	z.enc = dst
+	return len(dst)
+}
+
+// lzReader decompresses the blocks written by lzWriter.
+type lzReader struct {
+	r     *bufio.Reader
+	block []byte
+	enc   []byte
+	pos   int
+}
+
+func newLZReader(r *bufio.Reader) *lzReader {
+	return &lzReader{r: r}
+}
+
+func (z *lzReader) Read(p []byte) (int, error) {
+	if z.pos == len(z.block) {
+		if err := z.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, z.block[z.pos:])
+	z.pos += n
+	return n, nil
+}
+
+// next reads and decodes the next block.
+func (z *lzReader) next() error {
+	size, err := binary.ReadUvarint(z.r)
+	if err != nil {
+		return err
+	}
+	encoded, err := binary.ReadUvarint(z.r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if size == 0 || size > lzBlockSize || encoded >= size {
+		return errCorruptLZ
+	}
+
+	z.pos = 0
+	if encoded == 0 {
+		z.block = grow(z.block, int(size))
+		_, err := io.ReadFull(z.r, z.block)
+		return unexpectedEOF(err)
+	}
+	z.enc = grow(z.enc, int(encoded))
+	if _, err := io.ReadFull(z.r, z.enc); err != nil {
+		return unexpectedEOF(err)
+	}
+	z.block, err = lzDecode(z.block[:0], z.enc, int(size))
+	return err
+}
+
+// lzDecode appends the size bytes encoded by src to dst.
+func lzDecode(dst, src []byte, size int) ([]byte, error) {
+	for len(dst) < size {
+		literals, n := binary.Uvarint(src)
+		if n <= 0 || literals > uint64(len(src)-n) || literals > uint64(size-len(dst)) {
+			return nil, errCorruptLZ
+		}
+		src = src[n:]
+		dst = append(dst, src[:literals]...)
+		src = src[literals:]
+		if len(dst) == size {
+			break
+		}
+
+		offset, n := binary.Uvarint(src)
+		if n <= 0 || offset == 0 || offset > uint64(len(dst)) {
+			return nil, errCorruptLZ
+		}
+		src = src[n:]
+		extra, n := binary.Uvarint(src)
+		left := uint64(size - len(dst))
+		if n <= 0 || left < lzMinMatch || extra > left-lzMinMatch {
+			return nil, errCorruptLZ
+		}
+		src = src[n:]
+		from, length := len(dst)-int(offset), int(extra)+lzMinMatch
+		if length <= int(offset) {
+			dst = append(dst, dst[from:from+length]...)
+			continue
+		}
+		// The match overlaps the bytes it produces, so copy them one by one.
+		for i := range length {
+			dst = append(dst, dst[from+i])
+		}
+	}
+	if len(src) != 0 {
+		return nil, errCorruptLZ
+	}
+	return dst, nil
+}
+
+// grow returns b resized to n bytes, reusing its memory when it can.
+func grow(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package extsort
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func lzCompress(t *testing.T, data []byte, write int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	z := newLZWriter(&b)
+	for p := data; len(p) > 0; {
+		n := min(len(p), write)
+		if _, err := z.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func lzDecompress(compressed []byte) ([]byte, error) {
+	return io.ReadAll(newLZReader(bufio.NewReader(bytes.NewReader(compressed))))
+}
+
+func TestLZRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 3*lzBlockSize+17)
+	rng.Read(random)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("abc")},
+		{"run", bytes.Repeat([]byte{'a'}, lzBlockSize+5)},
+		{"pattern", bytes.Repeat([]byte("0123456789abc"), 20000)},
+		{"records", duplicateInput(10000, 1000)},
+		{"random", random},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, write := range []int{1 << 30, 1000, 1} {
+				if write == 1 && len(tc.data) > lzBlockSize {
+					continue
+				}
+				compressed := lzCompress(t, tc.data, write)
+				got, err := lzDecompress(compressed)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tc.data) {
+					t.Fatalf("writes of %d: decompressed %d bytes differ from the %d written", write, len(got), len(tc.data))
+				}
+			}
+		})
+	}
+
+	records := duplicateInput(10000, 1000)
+	if n := len(lzCompress(t, records, 1<<30)); n >= len(records)*3/4 {
+		t.Errorf("records compressed to %d bytes of %d", n, len(records))
+	}
+}
+
+func TestLZCorrupt(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abc"), 1000)
+	compressed := lzCompress(t, data, len(data))
+	if _, err := lzDecompress(compressed[:len(compressed)-1]); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated stream: %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	// An offset pointing before the start of the block.
+	bad := []byte{10, 4, 0, 1, 0, 0}
+	if _, err := lzDecompress(bad); !errors.Is(err, errCorruptLZ) {
+		t.Errorf("offset before the block: %v, want %v", err, errCorruptLZ)
+	}
+}
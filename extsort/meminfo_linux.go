@@ -0,0 +1,46 @@
+//go:build linux
+
+package extsort
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+)
+
+// residentMemory returns the resident set size of the process, reading
+// VmRSS from /proc/self/status.
+func residentMemory() (uint64, bool) {
+	return readMemInfo("/proc/self/status", "VmRSS:")
+}
+
+// readMemInfo returns the size in the line of file that starts with field,
+// which reads like "VmRSS:    1234 kB".
+func readMemInfo(file, field string) (uint64, bool) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		value, ok := bytes.CutPrefix(line, []byte(field))
+		if !ok {
+			continue
+		}
+		fields := bytes.Fields(value)
+		if len(fields) == 0 {
+			return 0, false
+		}
+		kb, err := strconv.ParseUint(string(fields[0]), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return kb << 10, true
+	}
+	return 0, false
+}
+
+// availableMemory returns the memory the system can give to processes
+// without swapping, reading MemAvailable from /proc/meminfo.
+func availableMemory() (uint64, bool) {
+	return readMemInfo("/proc/meminfo", "MemAvailable:")
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package extsort
+
+// residentMemory returns the resident set size of the process, which is
+// only known on Linux.
+func residentMemory() (uint64, bool) {
+	return 0, false
+}
+
+// availableMemory returns the memory the system can give to processes,
+// which is only known on Linux.
+func availableMemory() (uint64, bool) {
+	return 0, false
+}
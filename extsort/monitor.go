@@ -0,0 +1,230 @@
+package extsort
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// Kinds of MemoryEvent.
+const (
+	// MemorySample is taken every MonitorOptions.Interval.
+	MemorySample = "sample"
+	// MemoryBreach is a sample that went over the limit after one that did
+	// not.
+	MemoryBreach = "breach"
+)
+
+// DefaultMonitorInterval is the sampling interval of a MemoryMonitor when
+// MonitorOptions.Interval is zero.
+const DefaultMonitorInterval = 500 * time.Millisecond
+
+// MemoryEvent is a sample of the memory of the process.
+type MemoryEvent struct {
+	Kind string    `json:"kind"`
+	Time time.Time `json:"time"`
+	// HeapBytes is the heap memory in use.
+	HeapBytes uint64 `json:"heap_bytes"`
+	// RSSBytes is the resident set size, or 0 where it is not known.
+	RSSBytes uint64 `json:"rss_bytes,omitempty"`
+	// GCCycles is the number of garbage collections since the monitor
+	// started.
+	GCCycles uint64 `json:"gc_cycles"`
+	// Limit is the limit of the monitor, or 0 if it has none.
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// used is the memory compared with the limit: the resident set size where
+// it is known, the heap otherwise.
+func (e MemoryEvent) used() uint64 {
+	if e.RSSBytes > 0 {
+		return e.RSSBytes
+	}
+	return e.HeapBytes
+}
+
+// MonitorOptions configures a MemoryMonitor.
+type MonitorOptions struct {
+	// Interval is the time between two samples. Zero selects
+	// DefaultMonitorInterval.
+	Interval time.Duration
+	// Limit is the memory budget in bytes the samples are checked against.
+	// Zero checks nothing.
+	Limit int64
+	// Strict makes a breach of Limit an error: the context returned by
+	// StartMemoryMonitor is canceled with a *MemoryLimitError, so a sort
+	// running under it stops, and Stop returns the error.
+	Strict bool
+	// Events, if not nil, receives every sample, never from two goroutines
+	// at once.
+	Events func(MemoryEvent)
+}
+
+// MemoryLimitError reports that the memory of the process went over the
+// limit of a strict MemoryMonitor.
+type MemoryLimitError struct {
+	Used  uint64
+	Limit int64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("memory limit exceeded: %d MB > %d MB", e.Used>>20, e.Limit>>20)
+}
+
+// MemoryReport sums up the samples of a MemoryMonitor.
+type MemoryReport struct {
+	PeakHeapBytes uint64 `json:"peak_heap_bytes"`
+	PeakRSSBytes  uint64 `json:"peak_rss_bytes,omitempty"`
+	GCCycles      uint64 `json:"gc_cycles"`
+	Samples       int    `json:"samples"`
+	Breaches      int    `json:"breaches"`
+}
+
+// MemoryMonitor samples the heap, the resident set size and the garbage
+// collections of the process on its own goroutine from StartMemoryMonitor
+// until Stop.
+type MemoryMonitor struct {
+	opts    MonitorOptions
+	cancel  context.CancelCauseFunc
+	stop    chan struct{}
+	done    chan struct{}
+	stopped sync.Once
+
+	mu       sync.Mutex
+	report   MemoryReport
+	startGC  uint64
+	over     bool
+	breached error // the first breach of a strict monitor
+}
+
+// StartMemoryMonitor starts sampling the memory until Stop is called or ctx
+// is done. The returned context is ctx, canceled on the first breach of a
+// strict monitor.
+func StartMemoryMonitor(ctx context.Context, opts MonitorOptions) (context.Context, *MemoryMonitor) {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultMonitorInterval
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	m := &MemoryMonitor{
+		opts:   opts,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	m.startGC = readMemory().GCCycles
+	m.sample()
+	go m.run(ctx)
+	return ctx, m
+}
+
+func (m *MemoryMonitor) run(ctx context.Context) {
+	defer close(m.done)
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sample()
+		case <-m.stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sample reads the memory, records the peaks and sends the event.
+func (m *MemoryMonitor) sample() {
+	e := readMemory()
+	e.Kind, e.Limit = MemorySample, m.opts.Limit
+
+	m.mu.Lock()
+	e.GCCycles -= m.startGC
+	r := &m.report
+	r.Samples++
+	r.PeakHeapBytes = max(r.PeakHeapBytes, e.HeapBytes)
+	r.PeakRSSBytes = max(r.PeakRSSBytes, e.RSSBytes)
+	r.GCCycles = e.GCCycles
+	over := m.opts.Limit > 0 && e.used() > uint64(m.opts.Limit)
+	if over && !m.over {
+		e.Kind = MemoryBreach
+		r.Breaches++
+		if m.opts.Strict && m.breached == nil {
+			m.breached = &MemoryLimitError{Used: e.used(), Limit: m.opts.Limit}
+			m.cancel(m.breached)
+		}
+	}
+	m.over = over
+	m.mu.Unlock()
+
+	if m.opts.Events != nil {
+		m.opts.Events(e)
+	}
+}
+
+// Report returns the samples taken so far.
+func (m *MemoryMonitor) Report() MemoryReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.report
+}
+
+// Stop stops the monitor after a last sample and returns its report. For a
+// strict monitor whose limit was breached, the error is a
+// *MemoryLimitError. Stop may be called more than once.
+func (m *MemoryMonitor) Stop() (MemoryReport, error) {
+	m.stopped.Do(func() {
+		close(m.stop)
+		<-m.done
+		m.sample()
+		m.cancel(nil)
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.report, m.breached
+}
+
+// LogMemory starts a MemoryMonitor of limit over ctx that logs every breach
+// of the limit to logger as a warning. The returned stop function stops the
+// monitor and logs its peaks.
+func LogMemory(ctx context.Context, logger *slog.Logger, limit int64) (context.Context, func()) {
+	ctx, monitor := StartMemoryMonitor(ctx, MonitorOptions{
+		Limit: limit,
+		Events: func(e MemoryEvent) {
+			if e.Kind == MemoryBreach {
+				logger.Warn("memory limit exceeded", "heap_bytes", e.HeapBytes, "rss_bytes", e.RSSBytes, "limit", e.Limit)
+			}
+		},
+	})
+	return ctx, func() {
+		report, _ := monitor.Stop()
+		logger.Info("memory",
+			"peak_heap_bytes", report.PeakHeapBytes, "peak_rss_bytes", report.PeakRSSBytes,
+			"gc_cycles", report.GCCycles, "breaches", report.Breaches)
+	}
+}
+
+// memoryMetrics are read from runtime/metrics, which unlike
+// runtime.ReadMemStats does not stop the world.
+var memoryMetrics = []string{heapMetric, "/gc/cycles/total:gc-cycles"}
+
+// readMemory samples the memory of the process.
+func readMemory() MemoryEvent {
+	samples := make([]metrics.Sample, len(memoryMetrics))
+	for i, name := range memoryMetrics {
+		samples[i].Name = name
+	}
+	metrics.Read(samples)
+	e := MemoryEvent{Time: time.Now()}
+	if v := samples[0].Value; v.Kind() == metrics.KindUint64 {
+		e.HeapBytes = v.Uint64()
+	}
+	if v := samples[1].Value; v.Kind() == metrics.KindUint64 {
+		e.GCCycles = v.Uint64()
+	}
+	e.RSSBytes, _ = residentMemory()
+	return e
+}
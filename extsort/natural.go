@@ -0,0 +1,261 @@
+package extsort
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// NaturalMerge is the two-tape natural merge sort: the input is split into
+// ascending runs that are distributed between the B and C tapes and merged
+// onto the A tape, until the tapes hold a single run each and the last
+// merge goes to the output.
+type NaturalMerge struct {
+	Config
+}
+
+func (s NaturalMerge) Sort(ctx context.Context, r io.Reader, w io.Writer) (err error) {
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+	dirs, err := newTempDirs(s.TempDirs)
+	if err != nil {
+		return err
+	}
+	cp := newCheckpoint(s.Checkpoint, "natural", c, s.Order, dirs)
+	progress := newProgress("natural", s.Progress, s.Stats, r, naturalSweeps)
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	defer func() {
+		err = cp.finish(dirs, err)
+		progress.finish(err)
+	}()
+	tapes := newTapeSet(dirs, newMemoryBudget(s.MemoryLimit, c), c)
+	progress.phase(PhaseRuns, 0, 0, false)
+
+	in, err := newInputReader(r, tapes.bufSize)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	dist, err := distributeRuns(ctx, st, in, tapes.bufSize, tapes.codec, tapes.b, tapes.c)
+	if err != nil {
+		return fmt.Errorf("failed to distribute runs: %w", err)
+	}
+	if err := cp.save(stageDistributed, 0, dist...); err != nil {
+		return err
+	}
+	return mergePasses(ctx, st, dist[0].Runs, dist[1].Runs, 1, w, tapes, cp)
+}
+
+func (s NaturalMerge) resume(ctx context.Context, cp *checkpoint, dirs tempDirs, w io.Writer) (err error) {
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+	progress := newProgress("natural", s.Progress, s.Stats, nil, naturalSweeps)
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	c.disk.reopened(cp.m.Tapes...)
+	defer func() { progress.finish(err) }()
+	return resumePasses(ctx, st, cp, w, newTapeSet(dirs, newMemoryBudget(s.MemoryLimit, c), c))
+}
+
+// naturalSweeps estimates the sweeps of the natural merge: each pass but
+// the last merges the runs and distributes them again.
+func naturalSweeps(runs int) int {
+	return 2*mergeSweeps(runs, 2) - 1
+}
+
+// The stages of the natural merge saved by a checkpoint: the runs are on
+// the B and C tapes, or merged onto the A tape.
+const (
+	stageDistributed = "distributed"
+	stageMerged      = "merged"
+)
+
+// tapeSet names the three tapes of the two-way natural merge.
+type tapeSet struct {
+	a, b, c string
+	bufSize int // buffer size of each of the three open tapes
+	codec   codec
+}
+
+// newTapeSet names the tapes in dirs. A merge reads two tapes and writes
+// one, a distribution the other way around, which costs more with
+// compression, so the buffers are sized for it.
+func newTapeSet(dirs tempDirs, budget memoryBudget, c codec) tapeSet {
+	return tapeSet{
+		a:       dirs.path(0, "tape_A.tmp"),
+		b:       dirs.path(1, "tape_B.tmp"),
+		c:       dirs.path(2, "tape_C.tmp"),
+		bufSize: budget.mergeBuffer(1, 2),
+		codec:   c,
+	}
+}
+
+// resumePasses goes on with the natural merge from the stage saved by cp.
+func resumePasses(ctx context.Context, st *sortState, cp *checkpoint, w io.Writer, tapes tapeSet) error {
+	pass := cp.m.Step
+	if cp.m.Stage == stageMerged {
+		st.progress.phase(PhaseDistribute, pass, 0, false)
+		dist, err := distributeFile(ctx, st, tapes)
+		if err != nil {
+			return fmt.Errorf("failed to distribute runs: %w", err)
+		}
+		if err := cp.save(stageDistributed, pass, dist...); err != nil {
+			return err
+		}
+		cp.m.Tapes = dist
+	}
+	if len(cp.m.Tapes) != 2 {
+		return fmt.Errorf("invalid checkpoint: %d tapes", len(cp.m.Tapes))
+	}
+	return mergePasses(ctx, st, cp.m.Tapes[0].Runs, cp.m.Tapes[1].Runs, pass+1, w, tapes, cp)
+}
+
+// mergePasses merges the B and C tapes, holding runsB and runsC runs, onto A
+// and redistributes A until the tapes hold at most one run each, then
+// merges them into w. pass numbers the first merge for the checkpoint.
+func mergePasses(ctx context.Context, st *sortState, runsB, runsC int, pass int, w io.Writer, tapes tapeSet, cp *checkpoint) error {
+	progress := st.progress
+	for ; runsB+runsC > 2; pass++ {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		runs := runsB + runsC
+		progress.phase(PhaseMerge, pass, runs, true)
+
+		out, err := createTape(tapes.a, tapes.bufSize, tapes.codec)
+		if err != nil {
+			return err
+		}
+		if err := mergeTapes(ctx, st, out, tapes); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to merge files: %w", err)
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		if err := cp.save(stageMerged, pass, out.tapeFile()); err != nil {
+			return err
+		}
+		progress.phase(PhaseDistribute, pass, (runs+1)/2, true)
+
+		dist, err := distributeFile(ctx, st, tapes)
+		if err != nil {
+			return fmt.Errorf("failed to distribute runs: %w", err)
+		}
+		if err := cp.save(stageDistributed, pass, dist...); err != nil {
+			return err
+		}
+		runsB, runsC = dist[0].Runs, dist[1].Runs
+	}
+
+	progress.phase(PhaseMerge, pass, runsB+runsC, true)
+	out := newOutputWriter(w, tapes.bufSize)
+	if err := mergeTapes(ctx, st, out, tapes); err != nil {
+		return fmt.Errorf("failed to merge files: %w", err)
+	}
+	return out.Close()
+}
+
+// distributeFile splits the A tape into runs again and writes them to B and C.
+func distributeFile(ctx context.Context, st *sortState, tapes tapeSet) ([]tapeFile, error) {
+	src, err := openTape(tapes.a, tapes.bufSize, false, tapes.codec)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return distributeRuns(ctx, st, src, tapes.bufSize, tapes.codec, tapes.b, tapes.c)
+}
+
+// distributeRuns splits the records of src into ascending runs and writes
+// them to the files in turn. It returns the files with their run counts.
+func distributeRuns(ctx context.Context, st *sortState, src *runReader, bufSize int, c codec, files ...string) ([]tapeFile, error) {
+	outputs := make([]*tapeWriter, len(files))
+	for i, name := range files {
+		out, err := createTape(name, bufSize, c)
+		if err != nil {
+			return nil, err
+		}
+		defer out.Close()
+		outputs[i] = out
+	}
+
+	runs := 0
+	var currOutput *tapeWriter
+
+	check := newBatchCheck(ctx, st)
+	defer check.flush()
+	start := runStart{order: check.order}
+	for src.inRun {
+		if err := check.record(src.key, len(src.payload)); err != nil {
+			return nil, err
+		}
+		if start.next(src) {
+			currOutput = outputs[runs%len(outputs)]
+			currOutput.beginRun()
+			check.progress.addRun()
+			runs++
+		}
+
+		if err := copyRecord(currOutput, src); err != nil {
+			return nil, err
+		}
+	}
+
+	written := make([]tapeFile, len(outputs))
+	for i, out := range outputs {
+		if err := out.Close(); err != nil {
+			return nil, err
+		}
+		written[i] = out.tapeFile()
+	}
+	return written, nil
+}
+
+// mergeTapes merges the runs of the B and C tapes pairwise into out.
+func mergeTapes(ctx context.Context, st *sortState, out *tapeWriter, tapes tapeSet) error {
+	b, err := openTape(tapes.b, tapes.bufSize, true, tapes.codec)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	c, err := openTape(tapes.c, tapes.bufSize, true, tapes.codec)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	check := newBatchCheck(ctx, st)
+	defer check.flush()
+	for !b.eof || !c.eof {
+		for b.inRun && c.inRun {
+			next := c
+			check.compares++
+			if check.order.compareReaders(b, c) <= 0 {
+				next = b
+			}
+			if err := check.record(next.key, len(next.payload)); err != nil {
+				return err
+			}
+			if err := copyRecord(out, next); err != nil {
+				return err
+			}
+		}
+		for _, t := range []*runReader{b, c} {
+			for t.inRun {
+				if err := check.record(t.key, len(t.payload)); err != nil {
+					return err
+				}
+				if err := copyRecord(out, t); err != nil {
+					return err
+				}
+			}
+			t.nextRun()
+		}
+	}
+	return nil
+}
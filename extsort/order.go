@@ -0,0 +1,71 @@
+package extsort
+
+import "cmp"
+
+// Order is the order a sort puts the records in. The zero Order sorts them
+// by ascending key.
+type Order struct {
+	// Descending sorts the records from the largest down.
+	Descending bool
+	// Compare, if not nil, orders the records in place of their keys. It
+	// returns a negative number if a sorts before b, a positive number if
+	// after and zero if neither, and must be consistent, as for
+	// slices.SortFunc. A sort with a custom Compare parses the records it
+	// compares, so it runs slower.
+	Compare func(a, b Record) int
+}
+
+// compareKeys compares two keys in the order. It serves orders without a
+// custom Compare.
+func (o Order) compareKeys(a, b int64) int {
+	if o.Descending {
+		return cmp.Compare(b, a)
+	}
+	return cmp.Compare(a, b)
+}
+
+// compareRecords compares two records in the order.
+func (o Order) compareRecords(a, b Record) int {
+	switch {
+	case o.Compare == nil:
+		return o.compareKeys(a.Key, b.Key)
+	case o.Descending:
+		return o.Compare(b, a)
+	default:
+		return o.Compare(a, b)
+	}
+}
+
+// compareReaders compares the current records of two readers in the order.
+// Only a custom Compare needs them parsed.
+func (o Order) compareReaders(a, b *runReader) int {
+	if o.Compare == nil {
+		return o.compareKeys(a.key, b.key)
+	}
+	return o.compareRecords(a.record(), b.record())
+}
+
+// runStart finds the records of a stream that start a natural run: those
+// that sort before the record preceding them.
+type runStart struct {
+	order   Order
+	started bool
+	prevKey int64
+	prev    Record // the preceding record, for a custom Compare
+}
+
+// next reports whether the current record of t starts a run and remembers
+// it as the preceding record.
+func (s *runStart) next(t *runReader) bool {
+	var starts bool
+	if s.order.Compare != nil {
+		rec := t.record()
+		starts = !s.started || s.order.compareRecords(rec, s.prev) < 0
+		s.prev = rec
+	} else {
+		starts = !s.started || s.order.compareKeys(t.key, s.prevKey) < 0
+		s.prevKey = t.key
+	}
+	s.started = true
+	return starts
+}
@@ -0,0 +1,110 @@
+package extsort
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// byWord orders the records by word, then by key.
+func byWord(a, b Record) int {
+	if c := strings.Compare(a.Word, b.Word); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Key, b.Key)
+}
+
+// wordInput returns lines records with words and keys that sort apart.
+func wordInput(lines int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	for range lines {
+		fmt.Fprintf(&b, "%d\tw%03d\t2024-01-%02d\n", rng.Int63n(1000)-500, rng.Intn(200), 1+rng.Intn(28))
+	}
+	return b.Bytes()
+}
+
+func parseRecords(t *testing.T, data []byte) []Record {
+	t.Helper()
+	var records []Record
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		rec, err := ParseRecord(scanner.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestSortOrder(t *testing.T) {
+	in := wordInput(5000)
+	want, err := DigestRecords(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := []struct {
+		name  string
+		order Order
+		cmp   func(a, b Record) int
+	}{
+		{"descending", Order{Descending: true}, func(a, b Record) int { return cmp.Compare(b.Key, a.Key) }},
+		{"compare", Order{Compare: byWord}, byWord},
+		{"compare descending", Order{Compare: byWord, Descending: true}, func(a, b Record) int { return byWord(b, a) }},
+	}
+	type config struct {
+		name string
+		opts Options
+	}
+	var configs []config
+	for _, algorithm := range Algorithms {
+		opts := Options{Algorithm: algorithm, ChunkLines: 300, MaxFanIn: 4}
+		configs = append(configs, config{algorithm, opts})
+		if algorithm == "chunked" || algorithm == "kway" {
+			opts.RunGeneration = RunsReplacement
+			configs = append(configs, config{algorithm + " replacement", opts})
+		}
+	}
+	for _, o := range orders {
+		for _, c := range configs {
+			t.Run(o.name+"/"+c.name, func(t *testing.T) {
+				opts := c.opts
+				opts.TempDirs = []string{t.TempDir()}
+				opts.Order = o.order
+				var out bytes.Buffer
+				if err := Sort(context.Background(), bytes.NewReader(in), &out, opts); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := o.order.Verify(bytes.NewReader(out.Bytes()), &want); err != nil {
+					t.Fatal(err)
+				}
+				if records := parseRecords(t, out.Bytes()); !slices.IsSortedFunc(records, o.cmp) {
+					t.Fatal("records out of order")
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyOrder(t *testing.T) {
+	// Sorted by word, but not by key.
+	data := []byte("5\ta\td\n1\tb\td\n3\tb\td\n2\tc\td\n")
+	if _, err := (Order{Compare: byWord}).Verify(bytes.NewReader(data), nil); err != nil {
+		t.Errorf("sorted by word: %v", err)
+	}
+	var orderErr *OrderError
+	if _, err := Verify(bytes.NewReader(data), nil); !errors.As(err, &orderErr) || orderErr.Line != 2 {
+		t.Errorf("by key: %v, want an OrderError on line 2", err)
+	}
+	if _, err := (Order{Compare: byWord, Descending: true}).Verify(bytes.NewReader(data), nil); !errors.As(err, &orderErr) || orderErr.Line != 2 {
+		t.Errorf("by word descending: %v, want an OrderError on line 2", err)
+	}
+}
@@ -0,0 +1,332 @@
+package extsort
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+const defaultPolyphaseTapes = 4
+
+// PolyphaseMerge is the polyphase merge sort. The natural runs of the input
+// are distributed over Tapes-1 tapes following the generalized Fibonacci
+// numbers of order Tapes-1, padding with dummy runs. Each phase then merges
+// onto the empty tape until one of the inputs runs out, which becomes the
+// output of the next phase, so no pass is spent on redistribution.
+//
+// A checkpoint saves only the distribution: every later phase leaves its
+// input tapes partly read, which a resumed sort could not go back to. The
+// progress reports every phase as a pass.
+type PolyphaseMerge struct {
+	Config
+	// Tapes is the number of tapes, at least 3. Zero selects 4.
+	Tapes int
+}
+
+// polyTape is one tape of the polyphase merge.
+type polyTape struct {
+	name   string
+	reader *runReader
+	runs   int // runs left on the tape, dummy runs included
+	dummy  int // dummy runs, merged before the real ones
+}
+
+func (t *polyTape) open(bufSize int, c codec) error {
+	reader, err := openTape(t.name, bufSize, true, c)
+	if err != nil {
+		return err
+	}
+	t.reader = reader
+	return nil
+}
+
+func (t *polyTape) close() {
+	if t.reader != nil {
+		t.reader.Close()
+		t.reader = nil
+	}
+}
+
+func (s PolyphaseMerge) Sort(ctx context.Context, r io.Reader, w io.Writer) (err error) {
+	n := s.Tapes
+	if n == 0 {
+		n = defaultPolyphaseTapes
+	}
+	if n < 3 {
+		return fmt.Errorf("polyphase merge needs at least 3 tapes, got %d", n)
+	}
+
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+
+	dirs, err := newTempDirs(s.TempDirs)
+	if err != nil {
+		return err
+	}
+	cp := newCheckpoint(s.Checkpoint, "polyphase", c, s.Order, dirs)
+	progress := newProgress("polyphase", s.Progress, s.Stats, r, polyphaseSweeps(n))
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	defer func() {
+		err = cp.finish(dirs, err)
+		progress.finish(err)
+	}()
+	progress.phase(PhaseRuns, 0, 0, false)
+
+	tapes := newPolyTapes(dirs, n)
+	defer closePolyTapes(tapes)
+
+	// Every tape is open in each phase, and the input takes the place of the
+	// empty one while the runs are distributed. The distribution writes all
+	// of the others, which costs the most with compression.
+	bufSize := newMemoryBudget(s.MemoryLimit, c).mergeBuffer(1, n-1)
+	written, err := distributePolyphase(ctx, st, r, tapes, bufSize, c)
+	if err != nil {
+		return fmt.Errorf("failed to distribute runs: %w", err)
+	}
+	if err := cp.save("distributed", 0, written...); err != nil {
+		return err
+	}
+	return mergePolyphase(ctx, st, w, tapes, bufSize, c, cp)
+}
+
+// resume merges the distributed tapes saved by cp. The number of tapes is
+// that of the job.
+func (s PolyphaseMerge) resume(ctx context.Context, cp *checkpoint, dirs tempDirs, w io.Writer) (err error) {
+	n := len(cp.m.Tapes) + 1
+	if n < 3 {
+		return fmt.Errorf("invalid checkpoint: %d tapes", len(cp.m.Tapes))
+	}
+	c, err := newCodec(s.Compression, s.CompressionStats)
+	if err != nil {
+		return err
+	}
+	progress := newProgress("polyphase", s.Progress, s.Stats, nil, polyphaseSweeps(n))
+	st := &sortState{order: s.Order, progress: progress}
+	c.disk = progress.diskUsage()
+	c.disk.reopened(cp.m.Tapes...)
+	defer func() { progress.finish(err) }()
+
+	tapes := newPolyTapes(dirs, n)
+	defer closePolyTapes(tapes)
+
+	bufSize := newMemoryBudget(s.MemoryLimit, c).mergeBuffer(1, n-1)
+	for i, saved := range cp.m.Tapes {
+		t := tapes[i]
+		t.runs, t.dummy = saved.Runs+saved.Dummy, saved.Dummy
+		if err := t.open(bufSize, c); err != nil {
+			return err
+		}
+	}
+	return mergePolyphase(ctx, st, w, tapes, bufSize, c, cp)
+}
+
+// polyphaseSweeps estimates the sweeps of the polyphase merge of n tapes as
+// those of a merge of n-1 runs at a time.
+func polyphaseSweeps(n int) sweepFunc {
+	return func(runs int) int { return mergeSweeps(runs, n-1) }
+}
+
+func newPolyTapes(dirs tempDirs, n int) []*polyTape {
+	tapes := make([]*polyTape, n)
+	for i := range tapes {
+		tapes[i] = &polyTape{name: dirs.path(i, fmt.Sprintf("tape_%d.tmp", i))}
+	}
+	return tapes
+}
+
+func closePolyTapes(tapes []*polyTape) {
+	for _, t := range tapes {
+		t.close()
+	}
+}
+
+// distributePolyphase writes the natural runs of r to all tapes but the last
+// one following Knuth's algorithm D, and records the runs and dummy runs of
+// every tape. It returns the tapes written.
+func distributePolyphase(ctx context.Context, st *sortState, r io.Reader, tapes []*polyTape, bufSize int, c codec) ([]tapeFile, error) {
+	p := len(tapes) - 1
+	writers := make([]*tapeWriter, p)
+	for i := range writers {
+		out, err := createTape(tapes[i].name, bufSize, c)
+		if err != nil {
+			return nil, err
+		}
+		defer out.Close()
+		writers[i] = out
+	}
+
+	// a holds the perfect distribution of the current level and d how many
+	// runs each tape still lacks to reach it. a[p] and d[p] stay zero.
+	a := make([]int, p+1)
+	d := make([]int, p+1)
+	for i := range p {
+		a[i], d[i] = 1, 1
+	}
+	j := 0
+	nextTape := func() {
+		if d[j] < d[j+1] {
+			j++
+			return
+		}
+		if d[j] == 0 {
+			a0 := a[0]
+			for k := range p {
+				d[k] = a0 + a[k+1] - a[k]
+				a[k] = a0 + a[k+1]
+			}
+		}
+		j = 0
+	}
+
+	in, err := newInputReader(r, bufSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input: %w", err)
+	}
+	first := true
+	check := newBatchCheck(ctx, st)
+	defer check.flush()
+	start := runStart{order: check.order}
+	for in.inRun {
+		if err := check.record(in.key, len(in.payload)); err != nil {
+			return nil, err
+		}
+		if start.next(in) {
+			if !first {
+				nextTape()
+			}
+			writers[j].beginRun()
+			check.progress.addRun()
+			d[j]--
+		}
+		first = false
+		if err := copyRecord(writers[j], in); err != nil {
+			return nil, err
+		}
+	}
+
+	written := make([]tapeFile, p)
+	for i, out := range writers {
+		if err := out.Close(); err != nil {
+			return nil, err
+		}
+		tapes[i].runs, tapes[i].dummy = a[i], d[i]
+		if err := tapes[i].open(bufSize, c); err != nil {
+			return nil, err
+		}
+		written[i] = out.tapeFile()
+		written[i].Dummy = d[i]
+	}
+	return written, nil
+}
+
+// mergePolyphase runs the merge phases until the last one, which merges a
+// single run from every input tape into w. The checkpoint of the
+// distribution is discarded before its first tape is overwritten.
+func mergePolyphase(ctx context.Context, st *sortState, w io.Writer, tapes []*polyTape, bufSize int, c codec, cp *checkpoint) error {
+	out := len(tapes) - 1
+	for phase := 1; ; phase++ {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+
+		var inputs []*polyTape
+		merges, runs, last := 0, 0, true
+		for i, t := range tapes {
+			if i == out {
+				continue
+			}
+			inputs = append(inputs, t)
+			if merges == 0 || t.runs < merges {
+				merges = t.runs
+			}
+			runs += t.runs - t.dummy
+			last = last && t.runs == 1
+		}
+		st.progress.phase(PhaseMerge, phase, runs, last)
+
+		var writer *tapeWriter
+		if last {
+			writer = newOutputWriter(w, bufSize)
+		} else {
+			if out != len(tapes)-1 {
+				if err := cp.discard(); err != nil {
+					return err
+				}
+			}
+			var err error
+			if writer, err = createTape(tapes[out].name, bufSize, c); err != nil {
+				return err
+			}
+		}
+		dummy, err := mergePhase(ctx, st, writer, inputs, merges)
+		if err != nil {
+			writer.Close()
+			return fmt.Errorf("failed to merge files: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+
+		tapes[out].runs, tapes[out].dummy = merges, dummy
+		if err := tapes[out].open(bufSize, c); err != nil {
+			return err
+		}
+		for i, t := range tapes {
+			if i != out && t.runs == 0 {
+				t.close()
+				out = i
+				break
+			}
+		}
+	}
+}
+
+// mergePhase performs merges merges, taking one run from every input tape
+// for each. A tape with dummy runs left gives up a dummy instead; if every
+// input does, the output gets a dummy run. It returns the number of dummy
+// runs of the output.
+func mergePhase(ctx context.Context, st *sortState, out *tapeWriter, inputs []*polyTape, merges int) (int, error) {
+	check := newBatchCheck(ctx, st)
+	defer check.flush()
+	dummy := 0
+	active := make([]*runReader, 0, len(inputs))
+	for range merges {
+		active = active[:0]
+		for _, t := range inputs {
+			t.runs--
+			if t.dummy > 0 {
+				t.dummy--
+				continue
+			}
+			active = append(active, t.reader)
+		}
+		if len(active) == 0 {
+			dummy++
+			continue
+		}
+
+		out.beginRun()
+		if err := mergeRuns(check, out, active); err != nil {
+			return 0, err
+		}
+	}
+	return dummy, nil
+}
+
+// mergeRuns merges the current run of every reader into out and steps the
+// readers over the run boundary.
+func mergeRuns(check *batchCheck, out *tapeWriter, readers []*runReader) error {
+	if err := mergeReaders(check, out, readers); err != nil {
+		return err
+	}
+	for _, t := range readers {
+		t.nextRun()
+	}
+	return nil
+}
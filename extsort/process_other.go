@@ -0,0 +1,15 @@
+//go:build !unix
+
+package extsort
+
+import "os"
+
+// processAlive reports whether a process with the given id exists.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
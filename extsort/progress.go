@@ -0,0 +1,332 @@
+package extsort
+
+import (
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Phases of a sort, as reported in Progress.Phase.
+const (
+	// PhaseRuns reads the input and writes the initial runs.
+	PhaseRuns = "runs"
+	// PhaseMerge merges runs into longer runs or into the output.
+	PhaseMerge = "merge"
+	// PhaseDistribute splits the merged tape of the natural merge into runs
+	// again.
+	PhaseDistribute = "distribute"
+	// PhaseDone is reported once the output is written.
+	PhaseDone = "done"
+)
+
+// progressInterval is the least time between two reports within a phase.
+const progressInterval = 200 * time.Millisecond
+
+// Progress is a report on a running sort.
+type Progress struct {
+	// Phase is one of the Phase constants.
+	Phase string
+	// Pass numbers the merge passes from 1. It is 0 while the runs are built.
+	// The k-way merge numbers every merge by the level of the run it
+	// writes: 1 for a merge of the runs built from the input, one more than
+	// the highest level of its runs otherwise.
+	Pass int
+	// Bytes is the size of the records processed in the phase, counted as
+	// the lines they are read and written as.
+	Bytes int64
+	// TotalBytes is the size of the records the phase processes, or 0 if it
+	// is not known.
+	TotalBytes int64
+	// Runs is the number of runs written so far while the runs are built,
+	// and the number of runs left to merge afterwards.
+	Runs int
+	// Elapsed is the time since the sort started.
+	Elapsed time.Duration
+	// ETA is the estimated time left, or 0 while there is no estimate.
+	ETA time.Duration
+}
+
+// ProgressFunc receives the progress of a sort: at the start of every phase
+// and then every progressInterval at most. It is called on the goroutine
+// that runs the sort and should return quickly.
+type ProgressFunc func(Progress)
+
+// sweepFunc estimates how many times the merge of runs runs goes over all
+// of the records.
+type sweepFunc func(runs int) int
+
+// progressTracker collects the progress of one sort and reports it, and
+// sums it up in the Stats of the sort. A nil tracker, for a sort without a
+// ProgressFunc or Stats, does nothing.
+type progressTracker struct {
+	report ProgressFunc // nil if only the stats are collected
+	sweeps sweepFunc
+	start  time.Time
+	last   time.Time
+	p      Progress
+	input  int64 // size of the input, 0 if unknown
+	data   int64 // size of the records, known once the runs are built
+	work   int64 // bytes the whole sort is expected to process
+	done   int64 // bytes processed in all phases
+
+	// The merges copy records much faster than the runs are built from the
+	// input, so their rate is measured on its own.
+	mergeStart time.Time
+	mergeDone  int64 // done when the merges started
+
+	// The statistics, collected only if stats is not nil.
+	stats       *Stats
+	algorithm   string
+	phases      []PhaseStats
+	cur         PhaseStats // the phase in progress
+	curStart    time.Time
+	curRead     int64 // temporary bytes read when the phase started
+	curWritten  int64 // temporary bytes written when the phase started
+	curCompared int64 // comparisons when the phase started
+	inputBytes  int64 // read by the runs phase
+	compares    atomic.Int64
+	disk        *diskUsage
+	peakHeap    uint64
+}
+
+// newProgress tracks a sort by algorithm reading r, or resuming if r is nil.
+// The progress goes to report and the statistics to stats, either of which
+// may be nil.
+func newProgress(algorithm string, report ProgressFunc, stats *Stats, r io.Reader, sweeps sweepFunc) *progressTracker {
+	if report == nil && stats == nil {
+		return nil
+	}
+	now := time.Now()
+	t := &progressTracker{report: report, sweeps: sweeps, start: now, last: now}
+	if r != nil && report != nil {
+		t.input = inputSize(r)
+	}
+	if stats != nil {
+		t.stats, t.algorithm, t.disk = stats, algorithm, newDiskUsage()
+	}
+	return t
+}
+
+// inputSize returns the size of r if it is a regular file.
+func inputSize(r io.Reader) int64 {
+	f, ok := r.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return 0
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// diskUsage returns the counter of the temporary files for the codec of the
+// sort, or nil if no stats are collected.
+func (t *progressTracker) diskUsage() *diskUsage {
+	if t == nil {
+		return nil
+	}
+	return t.disk
+}
+
+// phase starts a phase with runs runs left. A phase over all of the
+// records, rather than some of the runs, has them as its TotalBytes.
+func (t *progressTracker) phase(name string, pass, runs int, all bool) {
+	if t == nil {
+		return
+	}
+	t.endPhase(false)
+	if t.mergeStart.IsZero() && name != PhaseRuns {
+		if t.p.Phase == PhaseRuns {
+			t.data = t.p.Bytes
+			t.work = t.data * int64(1+t.sweeps(max(runs, 1)))
+		}
+		t.mergeStart, t.mergeDone = time.Now(), t.done
+	}
+	t.p = Progress{Phase: name, Pass: pass, Runs: runs}
+	t.startPhase()
+	switch {
+	case name == PhaseRuns:
+		t.p.TotalBytes = t.input
+	case all:
+		t.p.TotalBytes = t.data
+	}
+	t.send()
+}
+
+// addRun counts a run written while the runs are built.
+func (t *progressTracker) addRun() {
+	if t != nil {
+		t.p.Runs++
+	}
+}
+
+// add counts records of the given size processed in the phase.
+func (t *progressTracker) add(records int, bytes int64) {
+	if t == nil {
+		return
+	}
+	t.p.Bytes += bytes
+	t.done += bytes
+	if t.stats != nil {
+		t.cur.Records += int64(records)
+		t.peakHeap = max(t.peakHeap, heapInUse())
+	}
+	if time.Since(t.last) >= progressInterval {
+		t.send()
+	}
+}
+
+// compared counts key comparisons. It may be called from any goroutine.
+func (t *progressTracker) compared(n int64) {
+	if t != nil {
+		t.compares.Add(n)
+	}
+}
+
+// finish reports the end of a sort that succeeded and fills in its Stats.
+func (t *progressTracker) finish(err error) {
+	if t == nil || err != nil {
+		return
+	}
+	output := t.p.Bytes
+	t.endPhase(true)
+	t.p = Progress{Phase: PhaseDone, Bytes: t.done}
+	t.send()
+	if t.stats != nil {
+		t.fillStats(output)
+	}
+}
+
+func (t *progressTracker) send() {
+	t.last = time.Now()
+	if t.report == nil {
+		return
+	}
+	t.p.Elapsed = t.last.Sub(t.start)
+	t.p.ETA = t.eta()
+	t.report(t.p)
+}
+
+func (t *progressTracker) startPhase() {
+	if t.stats == nil {
+		return
+	}
+	t.cur = PhaseStats{Phase: t.p.Phase, Pass: t.p.Pass, Runs: t.p.Runs}
+	t.curStart = time.Now()
+	t.curRead, t.curWritten = t.disk.read.Load(), t.disk.written.Load()
+	t.curCompared = t.compares.Load()
+	t.peakHeap = max(t.peakHeap, heapInUse())
+}
+
+// endPhase adds the phase in progress to the statistics. The runs phase
+// reads the input and the last phase writes the output.
+func (t *progressTracker) endPhase(last bool) {
+	if t.stats == nil || t.cur.Phase == "" {
+		return
+	}
+	t.cur.Duration = time.Since(t.curStart)
+	t.cur.BytesRead = t.disk.read.Load() - t.curRead
+	t.cur.BytesWritten = t.disk.written.Load() - t.curWritten
+	t.cur.Comparisons = t.compares.Load() - t.curCompared
+	if t.cur.Phase == PhaseRuns {
+		t.inputBytes = t.p.Bytes
+		t.cur.BytesRead += t.p.Bytes
+	}
+	if last {
+		t.cur.BytesWritten += t.p.Bytes
+	}
+	if t.cur.Phase != PhaseMerge {
+		// These phases write runs rather than merge them.
+		t.cur.Runs = t.p.Runs
+	}
+	t.phases = append(t.phases, t.cur)
+	t.cur = PhaseStats{}
+}
+
+// fillStats sums up the phases in the Stats of the sort, which wrote output
+// bytes.
+func (t *progressTracker) fillStats(output int64) {
+	s := Stats{
+		Algorithm:        t.algorithm,
+		Comparisons:      t.compares.Load(),
+		TempBytesRead:    t.disk.read.Load(),
+		TempBytesWritten: t.disk.written.Load(),
+		PeakTempBytes:    t.disk.peak,
+		PeakHeapBytes:    t.peakHeap,
+		Elapsed:          time.Since(t.start),
+		InputBytes:       t.inputBytes,
+		OutputBytes:      output,
+		Phases:           t.phases,
+	}
+	passes := make(map[int]bool)
+	for _, p := range t.phases {
+		switch p.Phase {
+		case PhaseRuns:
+			s.InitialRuns = p.Runs
+		case PhaseMerge:
+			s.Merges++
+			passes[p.Pass] = true
+		}
+	}
+	s.Passes = len(passes)
+	if n := len(t.phases); n > 0 {
+		s.Records = t.phases[n-1].Records
+	}
+	*t.stats = s
+}
+
+// eta estimates the time left from the bytes the sort is expected to
+// process and the rate of the merges, or of building the runs until the
+// merges start. While the runs are built, the number of runs is
+// extrapolated from the part of the input read.
+func (t *progressTracker) eta() time.Duration {
+	if t.p.Phase == PhaseDone || t.done == 0 {
+		return 0
+	}
+	if t.p.Phase == PhaseRuns {
+		if t.input == 0 || t.p.Bytes == 0 {
+			return 0
+		}
+		runs := max(int(float64(t.p.Runs)*float64(t.input)/float64(t.p.Bytes)), 1)
+		work := t.input * int64(1+t.sweeps(runs))
+		return time.Duration(float64(t.p.Elapsed) * float64(work-t.done) / float64(t.done))
+	}
+	merged := t.done - t.mergeDone
+	if t.work <= t.done || merged == 0 {
+		return 0
+	}
+	elapsed := t.last.Sub(t.mergeStart)
+	return time.Duration(float64(elapsed) * float64(t.work-t.done) / float64(merged))
+}
+
+// mergeSweeps estimates the sweeps of merging runs runs fanIn at a time.
+func mergeSweeps(runs, fanIn int) int {
+	if runs <= fanIn {
+		return 1
+	}
+	return int(math.Ceil(math.Log(float64(runs)) / math.Log(float64(fanIn))))
+}
+
+var pow10 = [20]uint64{
+	1, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9,
+	1e10, 1e11, 1e12, 1e13, 1e14, 1e15, 1e16, 1e17, 1e18, 1e19,
+}
+
+// textSize returns the length of the line of a record, newline included.
+func textSize(key int64, payload int) int {
+	n := payload + 2 // the tab and the newline
+	u := uint64(key)
+	if key < 0 {
+		u = -u
+		n++
+	}
+	digits := bits.Len64(u) * 1233 >> 12 // about log10(2) * bits
+	if u >= pow10[digits] {
+		digits++
+	}
+	return n + max(digits, 1)
+}
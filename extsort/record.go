@@ -0,0 +1,60 @@
+package extsort
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Record is a single line of a sorted file: key\tword\tdate.
+// Only Key takes part in comparisons, Word and Date are carried as data,
+// unless an Order.Compare compares them too.
+type Record struct {
+	Key  int64
+	Word string
+	Date string
+}
+
+// ParseRecord parses a line in the key\tword\tdate format.
+func ParseRecord(line string) (Record, error) {
+	parts := strings.SplitN(line, "\t", 3)
+	if len(parts) != 3 {
+		return Record{}, fmt.Errorf("invalid line format: %q", line)
+	}
+	key, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Record{}, fmt.Errorf("invalid key: %w", err)
+	}
+	return Record{
+		Key:  key,
+		Word: parts[1],
+		Date: parts[2],
+	}, nil
+}
+
+// splitLine parses the key of a line in the key\tword\tdate format and
+// returns it with the rest of the line, which is left as it is.
+func splitLine(line []byte) (int64, []byte, error) {
+	i := bytes.IndexByte(line, '\t')
+	if i < 0 || bytes.IndexByte(line[i+1:], '\t') < 0 {
+		return 0, nil, fmt.Errorf("invalid line format: %q", line)
+	}
+	key, err := strconv.ParseInt(string(line[:i]), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return key, line[i+1:], nil
+}
+
+// entryRecord returns the record with the key and the payload after its
+// tab, which holds the word and the date.
+func entryRecord(key int64, payload []byte) Record {
+	word, date, _ := strings.Cut(string(payload), "\t")
+	return Record{Key: key, Word: word, Date: date}
+}
+
+// String formats the record back into its line form without the trailing newline.
+func (r Record) String() string {
+	return fmt.Sprintf("%d\t%s\t%s", r.Key, r.Word, r.Date)
+}
@@ -0,0 +1,391 @@
+package extsort
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Run generation methods accepted by Options.RunGeneration.
+const (
+	// RunsSorted loads a chunk of records, sorts it in memory and writes it
+	// out as one run.
+	RunsSorted = "sort"
+	// RunsReplacement streams the input through a heap with replacement
+	// selection. Runs average twice the memory size on random input, and
+	// nearly sorted input yields a few long runs.
+	RunsReplacement = "replacement"
+)
+
+// nextRunFunc returns the writer for the next run, with the run already begun.
+type nextRunFunc func() (*tapeWriter, error)
+
+// runSize limits the records held in memory while a run is built.
+type runSize struct {
+	lines int       // at most this many records, unless zero
+	bytes int64     // at most this much memory by recordSize
+	sizer *runSizer // adapts bytes from run to run, if not nil
+}
+
+// adaptive returns s with its memory adapted to the memory pressure from
+// run to run if on is set.
+func (s runSize) adaptive(on bool) runSize {
+	if on {
+		s.sizer = newRunSizer(s.bytes)
+	}
+	return s
+}
+
+// nextRun sizes the next run once a run is complete.
+func (s *runSize) nextRun() {
+	if s.sizer != nil {
+		s.bytes = s.sizer.next(s.bytes)
+	}
+}
+
+// fits reports whether a record of size more bytes can join lines records
+// taking used bytes. The first record always fits.
+func (s runSize) fits(lines int, used, more int64) bool {
+	if lines == 0 {
+		return true
+	}
+	if s.lines > 0 && lines >= s.lines {
+		return false
+	}
+	return used+more <= s.bytes
+}
+
+// generateRuns splits the records of r into sorted runs that fit size with the
+// given method and writes each run to the writer returned by next. The input
+// is read through a bufSize buffer. If stable is set, records with equal keys
+// keep their input order within a run.
+func generateRuns(ctx context.Context, st *sortState, r io.Reader, method string, stable bool, size runSize, bufSize int, next nextRunFunc) error {
+	scanner := newScanner(r, bufSize)
+	switch method {
+	case RunsSorted, "":
+		return generateSortedRuns(ctx, st, scanner, stable, size, next)
+	case RunsReplacement:
+		return generateReplacementRuns(ctx, st, scanner, stable, size, next)
+	default:
+		return fmt.Errorf("unknown run generation method %q", method)
+	}
+}
+
+func generateSortedRuns(ctx context.Context, st *sortState, scanner *bufio.Scanner, stable bool, size runSize, next nextRunFunc) error {
+	var chunk []Record
+	var used int64
+	check := newBatchCheck(ctx, st)
+	defer check.flush()
+
+	flush := func() error {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		check.progress.compared(sortChunk(chunk, check.order, stable))
+		out, err := next()
+		if err != nil {
+			return err
+		}
+		check.progress.addRun()
+		for _, d := range chunk {
+			if err := out.writeRecord(d); err != nil {
+				return err
+			}
+		}
+		// Drop the records so the memory they hold can be reclaimed.
+		clear(chunk)
+		chunk, used = chunk[:0], 0
+		size.nextRun()
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if err := check.line(len(line) + 1); err != nil {
+			return err
+		}
+		data, err := ParseRecord(line)
+		if err != nil {
+			return fmt.Errorf("failed to parse line: %w", err)
+		}
+		if !size.fits(len(chunk), used, recordSize(line)) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		chunk = append(chunk, data)
+		used += recordSize(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	if len(chunk) > 0 {
+		return flush()
+	}
+	return nil
+}
+
+// sortChunk sorts the chunk in order, keeping equal records in input order
+// if stable is set, and returns the number of comparisons.
+func sortChunk(chunk []Record, order Order, stable bool) int64 {
+	var compares int64
+	less := func(i, j int) bool {
+		compares++
+		return order.compareRecords(chunk[i], chunk[j]) < 0
+	}
+	if stable {
+		sort.SliceStable(chunk, less)
+	} else {
+		sort.Slice(chunk, less)
+	}
+	return compares
+}
+
+// createRunFunc creates the writer for the run with the given index, counting
+// from zero in input order. It is called from several goroutines at once.
+type createRunFunc func(index int) (*tapeWriter, error)
+
+// generateSortedRunsParallel is generateSortedRuns with the sorting and
+// writing of the chunks done by workers goroutines while the input is read.
+// At most workers+1 chunks are held at once, so each should fit size. It
+// returns the number of runs, each already closed.
+func generateSortedRunsParallel(ctx context.Context, st *sortState, r io.Reader, stable bool, size runSize, bufSize, workers int, create createRunFunc) (int, error) {
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	type job struct {
+		index int
+		chunk []Record
+	}
+	jobs := make(chan job)
+	free := make(chan []Record, workers+1)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := writeSortedRun(j.chunk, st, stable, create, j.index); err != nil {
+					cancel(err)
+				}
+				// Drop the records so the memory they hold can be reclaimed.
+				clear(j.chunk)
+				select {
+				case free <- j.chunk[:0]:
+				default:
+				}
+			}
+		}()
+	}
+
+	runs := 0
+	var chunk []Record
+	var used int64
+	dispatch := func() bool {
+		select {
+		case jobs <- job{index: runs, chunk: chunk}:
+		case <-ctx.Done():
+			return false
+		}
+		runs++
+		st.progress.addRun()
+		select {
+		case chunk = <-free:
+		default:
+			chunk = nil
+		}
+		used = 0
+		size.nextRun()
+		return true
+	}
+
+	err := func() error {
+		scanner := newScanner(r, bufSize)
+		check := newBatchCheck(parent, st)
+		defer check.flush()
+		for scanner.Scan() {
+			line := scanner.Text()
+			if err := check.line(len(line) + 1); err != nil {
+				return err
+			}
+			data, err := ParseRecord(line)
+			if err != nil {
+				return fmt.Errorf("failed to parse line: %w", err)
+			}
+			if !size.fits(len(chunk), used, recordSize(line)) && !dispatch() {
+				return nil
+			}
+			chunk = append(chunk, data)
+			used += recordSize(line)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+		if len(chunk) > 0 {
+			dispatch()
+		}
+		return nil
+	}()
+	if err != nil {
+		cancel(err)
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := canceled(parent); err != nil {
+		return runs, err
+	}
+	return runs, context.Cause(ctx)
+}
+
+// writeSortedRun sorts the chunk in the order of the sort, stably if stable
+// is set, and writes it as the run index, counting the comparisons in the
+// progress of the sort. A panic is returned as an error: left alone on a
+// worker goroutine, it would end the process before the temporary files are
+// removed.
+func writeSortedRun(chunk []Record, st *sortState, stable bool, create createRunFunc, index int) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic while writing run %d: %v", index, p)
+		}
+	}()
+
+	st.progress.compared(sortChunk(chunk, st.order, stable))
+	out, err := create(index)
+	if err != nil {
+		return err
+	}
+	for _, d := range chunk {
+		if err := out.writeRecord(d); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// selectionItem is a record waiting in the replacement selection heap.
+type selectionItem struct {
+	run  int
+	seq  int64 // input order
+	rec  Record
+	size int64
+}
+
+// selectionHeap orders records by run and then in the order of the sort, so
+// the records that start the next run sink below the ones of the current
+// run. A stable heap orders equal records by input order. It counts the
+// record comparisons.
+type selectionHeap struct {
+	items    []selectionItem
+	order    Order
+	stable   bool
+	compares int64
+}
+
+func (h *selectionHeap) Len() int { return len(h.items) }
+func (h *selectionHeap) Less(i, j int) bool {
+	if h.items[i].run != h.items[j].run {
+		return h.items[i].run < h.items[j].run
+	}
+	h.compares++
+	a, b := &h.items[i], &h.items[j]
+	c := h.order.compareRecords(a.rec, b.rec)
+	if h.stable && c == 0 {
+		return a.seq < b.seq
+	}
+	return c < 0
+}
+func (h *selectionHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *selectionHeap) Push(x interface{}) { h.items = append(h.items, x.(selectionItem)) }
+func (h *selectionHeap) Pop() interface{} {
+	old := h.items
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = selectionItem{}
+	h.items = old[0 : n-1]
+	return x
+}
+
+func generateReplacementRuns(ctx context.Context, st *sortState, scanner *bufio.Scanner, stable bool, size runSize, next nextRunFunc) error {
+	var used, seq int64
+
+	// pending is the next input record, read but not yet in the heap.
+	var pending selectionItem
+	hasPending := false
+	check := newBatchCheck(ctx, st)
+	h := selectionHeap{order: check.order, stable: stable}
+	defer func() {
+		check.compares += h.compares
+		check.flush()
+	}()
+	readPending := func() error {
+		hasPending = scanner.Scan()
+		if !hasPending {
+			return scanner.Err()
+		}
+		line := scanner.Text()
+		if err := check.line(len(line) + 1); err != nil {
+			return err
+		}
+		data, err := ParseRecord(line)
+		if err != nil {
+			return fmt.Errorf("failed to parse line: %w", err)
+		}
+		pending = selectionItem{seq: seq, rec: data, size: recordSize(line)}
+		seq++
+		return nil
+	}
+	if err := readPending(); err != nil {
+		return err
+	}
+
+	var out *tapeWriter
+	currRun := -1
+	var last Record
+	for {
+		// Refill the heap up to the budget; a record that sorts before the
+		// last one written cannot join the current run.
+		for hasPending && size.fits(h.Len(), used, pending.size) {
+			pending.run = max(currRun, 0)
+			if currRun >= 0 && h.order.compareRecords(pending.rec, last) < 0 {
+				pending.run++
+			}
+			heap.Push(&h, pending)
+			used += pending.size
+			if err := readPending(); err != nil {
+				return err
+			}
+		}
+		if h.Len() == 0 {
+			return nil
+		}
+
+		top := heap.Pop(&h).(selectionItem)
+		used -= top.size
+		if top.run != currRun {
+			if currRun >= 0 {
+				size.nextRun()
+			}
+			var err error
+			if out, err = next(); err != nil {
+				return err
+			}
+			check.progress.addRun()
+			currRun = top.run
+		}
+		if err := out.writeRecord(top.rec); err != nil {
+			return err
+		}
+		last = top.rec
+	}
+}
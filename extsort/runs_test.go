@@ -0,0 +1,83 @@
+package extsort
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// duplicateInput returns lines records with keys below keys, so most keys
+// repeat. The word of every record is its line number.
+func duplicateInput(lines int, keys int64) []byte {
+	rng := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	for i := range lines {
+		fmt.Fprintf(&b, "%d\tw%06d\t2024-01-01\n", rng.Int63n(keys), i)
+	}
+	return b.Bytes()
+}
+
+// checkStable fails t unless out holds the records of in in order, with
+// equal keys in their input order.
+func checkStable(t *testing.T, in, out []byte, order Order) {
+	t.Helper()
+	want, err := DigestRecords(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := order.Verify(bytes.NewReader(out), &want); err != nil {
+		t.Fatal(err)
+	}
+	var prev Record
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for n := 0; scanner.Scan(); n++ {
+		rec, err := ParseRecord(scanner.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 && rec.Key == prev.Key && rec.Word < prev.Word {
+			t.Fatalf("line %d: key %d: %s after %s", n+1, rec.Key, rec.Word, prev.Word)
+		}
+		prev = rec
+	}
+}
+
+func TestStableSort(t *testing.T) {
+	in := duplicateInput(20000, 50)
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"natural", Options{Algorithm: "natural"}},
+		{"balanced", Options{Algorithm: "balanced", Ways: 3}},
+		{"chunked", Options{Algorithm: "chunked", ChunkLines: 700}},
+		{"chunked replacement", Options{Algorithm: "chunked", ChunkLines: 700, RunGeneration: RunsReplacement}},
+		{"kway", Options{Algorithm: "kway", ChunkLines: 500, MaxFanIn: 3, Workers: 1}},
+		{"kway replacement", Options{Algorithm: "kway", ChunkLines: 500, MaxFanIn: 3, RunGeneration: RunsReplacement}},
+		{"kway parallel", Options{Algorithm: "kway", ChunkLines: 500, MaxFanIn: 3, Workers: 4}},
+		{"kway descending", Options{Algorithm: "kway", ChunkLines: 500, MaxFanIn: 3, Workers: 4,
+			Config: Config{Order: Order{Descending: true}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			opts.TempDirs = []string{t.TempDir()}
+			opts.Stable = true
+			var out bytes.Buffer
+			if err := Sort(context.Background(), bytes.NewReader(in), &out, opts); err != nil {
+				t.Fatal(err)
+			}
+			checkStable(t, in, out.Bytes(), opts.Order)
+		})
+	}
+}
+
+func TestStablePolyphase(t *testing.T) {
+	_, err := NewSorter(Options{Algorithm: "polyphase", Stable: true})
+	if err == nil || !strings.Contains(err.Error(), "stably") {
+		t.Fatalf("NewSorter(polyphase, Stable) = %v, want an error", err)
+	}
+}
@@ -0,0 +1,270 @@
+// Package extsort sorts text streams of key\tword\tdate records by key with
+// external merge sort algorithms that keep only a part of the data in memory.
+package extsort
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Sorter sorts records by key.
+type Sorter interface {
+	// Sort reads records from r and writes them sorted to w. r is read to the
+	// end before anything is written to w. Once ctx is canceled or its
+	// deadline passes, Sort stops within a batch of records, removes its
+	// temporary files and returns a *CanceledError.
+	Sort(ctx context.Context, r io.Reader, w io.Writer) error
+}
+
+var (
+	_ Sorter = NaturalMerge{}
+	_ Sorter = ChunkedMerge{}
+	_ Sorter = KWayMerge{}
+	_ Sorter = PolyphaseMerge{}
+	_ Sorter = BalancedMerge{}
+)
+
+// sortState is what the phases of one sort share besides its context.
+type sortState struct {
+	// order is the order of the records, which every comparison follows.
+	order Order
+	// progress tracks the sort, nil if nothing watches it.
+	progress *progressTracker
+}
+
+// Algorithms lists the algorithm names accepted by NewSorter.
+var Algorithms = []string{"natural", "chunked", "kway", "polyphase", "balanced"}
+
+// Config holds the settings shared by all of the algorithms.
+type Config struct {
+	// TempDirs are the directories where temporary files are created. Every
+	// sort makes a subdirectory with a unique name in each of them and
+	// spreads its files over them in turn, so several disks can share the
+	// work. Defaults to os.TempDir().
+	TempDirs []string
+	// MemoryLimit is the memory budget in bytes that sizes the runs built in
+	// memory and the file buffers. Zero selects DefaultMemoryLimit.
+	MemoryLimit int64
+	// Order is the order of the records: ascending keys by default,
+	// descending, or that of a custom comparator.
+	Order Order
+	// Compression is how the temporary runs are compressed: CompressionNone
+	// (the default), CompressionGzip or CompressionLZ. Every open compressed
+	// file keeps codec state, about 200KB with CompressionLZ and up to about
+	// 1MB while writing with CompressionGzip, which is taken from
+	// MemoryLimit: compression leaves less memory to the buffers and the
+	// runs, and the k-way merge merges fewer runs at once.
+	Compression string
+	// CompressionStats, if not nil, receives the statistics of the compression.
+	CompressionStats *CompressionStats
+	// Checkpoint makes the sort save its progress in a manifest in its job
+	// directory after each completed phase. If the sort then fails, the job
+	// directory is kept and the error is a *ResumableError naming it for
+	// Resume. The k-way, natural, chunked and balanced merges checkpoint
+	// every pass; the polyphase merge only its distribution.
+	Checkpoint bool
+	// Progress, if not nil, receives the progress of the sort: the phase,
+	// the pass, the bytes processed, the runs left and an estimate of the
+	// time left.
+	Progress ProgressFunc
+	// Stats, if not nil, receives the statistics of the sort once it
+	// succeeds: the runs, the passes, the bytes and time of every phase, the
+	// comparisons and the peak heap and temporary disk use.
+	Stats *Stats
+}
+
+// Options configures a sort: the algorithm, the settings shared by all of
+// them and those of each algorithm.
+type Options struct {
+	Config
+	// Algorithm is one of Algorithms. Defaults to "kway".
+	Algorithm string
+	// ChunkLines caps the number of records kept in memory while building
+	// runs by the chunked and k-way algorithms. Zero leaves only MemoryLimit.
+	ChunkLines int
+	// RunGeneration is how the chunked and k-way algorithms build their
+	// initial runs: RunsSorted (the default) or RunsReplacement.
+	RunGeneration string
+	// AdaptiveRuns makes the chunked and k-way algorithms shrink the runs
+	// they build in memory while the garbage collector is under pressure, or
+	// the system short of memory, and grow them back up to the budget once
+	// it is not.
+	AdaptiveRuns bool
+	// Stable keeps records with equal keys in their input order. The
+	// natural and balanced merges always do, and the chunked and k-way
+	// algorithms do when it is set. The polyphase merge cannot: its runs
+	// are merged out of input order, so it refuses Stable.
+	Stable bool
+	// Workers is the number of chunks the k-way algorithm sorts concurrently.
+	// Zero selects GOMAXPROCS.
+	Workers int
+	// MaxFanIn caps the number of runs the k-way algorithm merges at once.
+	// Zero leaves the limits from open files and MemoryLimit.
+	MaxFanIn int
+	// Tapes is the number of tapes of the polyphase merge. Zero selects the default.
+	Tapes int
+	// Ways is the number of runs the balanced merge merges at once. Zero selects the default.
+	Ways int
+	// InPlace lets SortFile replace its input with the sorted records. It
+	// refuses to otherwise, so the input is never overwritten by mistake.
+	InPlace bool
+}
+
+// NewSorter returns the Sorter for opts.Algorithm.
+func NewSorter(opts Options) (Sorter, error) {
+	switch opts.Algorithm {
+	case "natural":
+		return NaturalMerge{Config: opts.Config}, nil
+	case "chunked":
+		return ChunkedMerge{
+			Config:        opts.Config,
+			ChunkLines:    opts.ChunkLines,
+			RunGeneration: opts.RunGeneration,
+			AdaptiveRuns:  opts.AdaptiveRuns,
+			Stable:        opts.Stable,
+		}, nil
+	case "kway", "":
+		return KWayMerge{
+			Config:        opts.Config,
+			ChunkLines:    opts.ChunkLines,
+			RunGeneration: opts.RunGeneration,
+			AdaptiveRuns:  opts.AdaptiveRuns,
+			Stable:        opts.Stable,
+			MaxFanIn:      opts.MaxFanIn,
+			Workers:       opts.Workers,
+		}, nil
+	case "polyphase":
+		if opts.Stable {
+			return nil, fmt.Errorf("the polyphase merge cannot sort stably")
+		}
+		return PolyphaseMerge{Config: opts.Config, Tapes: opts.Tapes}, nil
+	case "balanced":
+		return BalancedMerge{Config: opts.Config, Ways: opts.Ways}, nil
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", opts.Algorithm)
+	}
+}
+
+// Sort reads records from r and writes them sorted to w with the algorithm
+// selected by opts. Temporary runs are created in opts.TempDirs and removed
+// before Sort returns.
+func Sort(ctx context.Context, r io.Reader, w io.Writer, opts Options) error {
+	sorter, err := NewSorter(opts)
+	if err != nil {
+		return err
+	}
+	return sorter.Sort(ctx, r, w)
+}
+
+// SortFile sorts the records of src into dst. The records are written to a
+// temporary file next to dst that is synced and renamed over dst only once
+// the sort succeeds, so dst is either left as it was or fully replaced.
+// src and dst may be the same file only if opts.InPlace is set.
+func SortFile(ctx context.Context, src, dst string, opts Options) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+
+	inInfo, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	return replaceFile(dst, func(info os.FileInfo) error {
+		if os.SameFile(info, inInfo) && !opts.InPlace {
+			return fmt.Errorf("%s is the input; set InPlace to sort it in place", dst)
+		}
+		return nil
+	}, func(out io.Writer) error {
+		return Sort(ctx, in, out, opts)
+	})
+}
+
+// SortToFile sorts the records of r into dst, which is replaced the way
+// SortFile does, so a failed sort leaves it as it was.
+func SortToFile(ctx context.Context, r io.Reader, dst string, opts Options) error {
+	return replaceFile(dst, nil, func(out io.Writer) error {
+		return Sort(ctx, r, out, opts)
+	})
+}
+
+// ResumeFile is Resume writing to dst the way SortFile does.
+func ResumeFile(ctx context.Context, job, dst string, opts Options) error {
+	return replaceFile(dst, nil, func(out io.Writer) error {
+		return Resume(ctx, job, out, opts)
+	})
+}
+
+// replaceFile atomically replaces dst, or the file it links to, with what
+// write writes. check, if not nil, may refuse an existing dst.
+func replaceFile(dst string, check func(os.FileInfo) error, write func(io.Writer) error) error {
+	// Replace the file a link points to rather than the link.
+	if target, err := filepath.EvalSymlinks(dst); err == nil {
+		dst = target
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(dst); err == nil {
+		if check != nil {
+			if err := check(info); err != nil {
+				return err
+			}
+		}
+		mode = info.Mode().Perm()
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create output: %w", err)
+	}
+	trackTemp(out.Name())
+	defer untrackTemp(out.Name())
+	renamed := false
+	defer func() {
+		if !renamed {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+
+	if err := write(out); err != nil {
+		return err
+	}
+	if err := out.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", dst, err)
+	}
+	renamed = true
+	syncDir(filepath.Dir(dst))
+	return nil
+}
+
+// syncDir makes a rename in dir durable. Not every platform can sync a
+// directory, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+func cleanupTempFiles(files ...string) {
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			os.Remove(file)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package extsort
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// edgeKeys are the keys the old sentinel records collided with, and the
+// ends of the key range.
+var edgeKeys = []int64{-1, 0, 99999, 100000, 100001, -100000, math.MinInt64, math.MinInt64 + 1, math.MaxInt64, math.MaxInt64 - 1}
+
+// edgeInput returns lines records whose keys are mostly edgeKeys, in a
+// random order with many short runs.
+func edgeInput(lines int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	for i := range lines {
+		key := edgeKeys[rng.Intn(len(edgeKeys))]
+		if rng.Intn(4) == 0 {
+			key = rng.Int63() - rng.Int63()
+		}
+		fmt.Fprintf(&b, "%d\tw%06d\t2024-01-01\n", key, i)
+	}
+	return b.Bytes()
+}
+
+func TestSortEdgeKeys(t *testing.T) {
+	in := edgeInput(5000)
+	want, err := DigestRecords(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, algorithm := range Algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			opts := Options{Algorithm: algorithm, ChunkLines: 300, MaxFanIn: 4}
+			opts.TempDirs = []string{t.TempDir()}
+			var out bytes.Buffer
+			if err := Sort(context.Background(), bytes.NewReader(in), &out, opts); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(bytes.NewReader(out.Bytes()), &want); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package extsort
+
+import (
+	"io"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is the report of a sort, filled in once it succeeds.
+type Stats struct {
+	// Algorithm is the name of the algorithm, as in Algorithms.
+	Algorithm string `json:"algorithm"`
+	// Records is the number of records sorted.
+	Records int64 `json:"records"`
+	// InputBytes and OutputBytes are the size of the lines read and written.
+	// A resumed sort reads no input.
+	InputBytes  int64 `json:"input_bytes"`
+	OutputBytes int64 `json:"output_bytes"`
+	// InitialRuns is the number of runs built from the input, or 0 for a
+	// resumed sort.
+	InitialRuns int `json:"initial_runs"`
+	// Passes is the number of merge passes over the records, the one into
+	// the output included, as numbered in Progress. A pass of the k-way
+	// merge is a level of its merge tree, which may take several merges.
+	Passes int `json:"passes"`
+	// Merges is the number of merge phases, one per pass but for the k-way
+	// merge, where a pass takes one phase per merge.
+	Merges int `json:"merges"`
+	// Comparisons is the number of key comparisons.
+	Comparisons int64 `json:"comparisons"`
+	// TempBytesRead and TempBytesWritten are the bytes read from and written
+	// to the temporary files, after compression.
+	TempBytesRead    int64 `json:"temp_bytes_read"`
+	TempBytesWritten int64 `json:"temp_bytes_written"`
+	// PeakTempBytes is the most the temporary files held at once.
+	PeakTempBytes int64 `json:"peak_temp_bytes"`
+	// PeakHeapBytes is the most heap memory in use seen while sorting,
+	// sampled every batch of records.
+	PeakHeapBytes uint64 `json:"peak_heap_bytes"`
+	// Elapsed is the time the sort took.
+	Elapsed time.Duration `json:"elapsed_ns"`
+	// Phases are the phases of the sort, in order.
+	Phases []PhaseStats `json:"phases"`
+}
+
+// PhaseStats is the report of one phase of a sort.
+type PhaseStats struct {
+	// Phase is one of the Phase constants and Pass numbers it as in Progress.
+	Phase string `json:"phase"`
+	Pass  int    `json:"pass,omitempty"`
+	// Runs is the number of runs written while the runs are built or
+	// distributed, and the number of runs merged otherwise.
+	Runs int `json:"runs"`
+	// Records is the number of records read in the phase.
+	Records int64 `json:"records"`
+	// BytesRead and BytesWritten count the input, the output and the
+	// temporary files.
+	BytesRead    int64         `json:"bytes_read"`
+	BytesWritten int64         `json:"bytes_written"`
+	Comparisons  int64         `json:"comparisons"`
+	Duration     time.Duration `json:"duration_ns"`
+}
+
+// diskUsage counts the bytes a sort reads from and writes to its temporary
+// files and the most the files hold at once. The runs of the k-way merge are
+// written by several goroutines at once. A nil diskUsage counts nothing.
+type diskUsage struct {
+	read    atomic.Int64
+	written atomic.Int64
+
+	mu    sync.Mutex
+	sizes map[string]int64 // size of every tape once it is closed
+	total int64
+	peak  int64
+}
+
+func newDiskUsage() *diskUsage {
+	return &diskUsage{sizes: make(map[string]int64)}
+}
+
+// reader counts the bytes read from r.
+func (d *diskUsage) reader(r io.Reader) io.Reader {
+	if d == nil {
+		return r
+	}
+	return readCounter{r: r, n: &d.read}
+}
+
+// writer counts the bytes written to w.
+func (d *diskUsage) writer(w io.Writer) io.Writer {
+	if d == nil {
+		return w
+	}
+	return writeCounter{w: w, n: &d.written}
+}
+
+// resize records the size of the tape name: 0 once it is created or
+// truncated, its length once it is closed.
+func (d *diskUsage) resize(name string, size int64) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.total += size - d.sizes[name]
+	d.sizes[name] = size
+	d.peak = max(d.peak, d.total)
+}
+
+// reopened records the tapes a resumed sort goes on from.
+func (d *diskUsage) reopened(tapes ...tapeFile) {
+	for _, t := range tapes {
+		d.resize(t.Path, t.Size)
+	}
+}
+
+// removed forgets the tapes that were deleted.
+func (d *diskUsage) removed(names ...string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, name := range names {
+		d.total -= d.sizes[name]
+		delete(d.sizes, name)
+	}
+}
+
+type readCounter struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+type writeCounter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (c writeCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// heapMetric is the heap memory taken by live and not yet swept objects.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+// heapInUse returns the heap memory in use. Unlike runtime.ReadMemStats it
+// does not stop the world, so it can be sampled often.
+func heapInUse() uint64 {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
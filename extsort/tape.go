@@ -0,0 +1,304 @@
+package extsort
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// Tapes hold records in a binary run format: the key as a varint, then the
+// length of the payload shifted left by one as a uvarint and the payload
+// itself, which is the line without the key and its tab. The low bit of the
+// length is set on the first record of every run, so run boundaries take no
+// sentinel key and no memory, and any record may be written. Lines are
+// parsed once when the input is read and formatted once when the output is
+// written, so the passes in between only compare keys and copy bytes.
+
+// tapeWriter writes runs to a temporary file.
+type tapeWriter struct {
+	name   string
+	file   *os.File       // nil when writing to the caller's output
+	sum    checksumWriter // checksum of what goes to the file
+	codec  *codecWriter   // nil when the tape is not compressed
+	writer *bufio.Writer
+	text   bool   // write lines instead of the run format
+	header []byte // scratch space for the encoded key and length
+	newRun bool   // the next record starts a run
+	runs   int    // runs written
+	disk   *diskUsage
+}
+
+func createTape(name string, bufSize int, c codec) (*tapeWriter, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	t := &tapeWriter{name: name, file: file, disk: c.disk}
+	t.sum.w = c.disk.writer(file)
+	c.disk.resize(name, 0)
+	t.codec = c.newWriter(&t.sum)
+	if t.codec != nil {
+		t.writer = bufio.NewWriterSize(t.codec, bufSize)
+	} else {
+		t.writer = bufio.NewWriterSize(&t.sum, bufSize)
+	}
+	return t, nil
+}
+
+// newOutputWriter wraps the caller's writer that receives the sorted lines.
+func newOutputWriter(w io.Writer, bufSize int) *tapeWriter {
+	return &tapeWriter{name: "output", writer: bufio.NewWriterSize(w, bufSize), text: true}
+}
+
+// beginRun starts a new run with the next record written. A run begun
+// without records is not written.
+func (t *tapeWriter) beginRun() {
+	t.newRun = true
+}
+
+// writeRecord writes a record parsed from the input.
+func (t *tapeWriter) writeRecord(rec Record) error {
+	t.writeHeader(rec.Key, len(rec.Word)+1+len(rec.Date))
+	t.writer.WriteString(rec.Word)
+	t.writer.WriteByte('\t')
+	t.writer.WriteString(rec.Date)
+	return t.endRecord()
+}
+
+// writeEntry writes a record read from a tape.
+func (t *tapeWriter) writeEntry(key int64, payload []byte) error {
+	t.writeHeader(key, len(payload))
+	t.writer.Write(payload)
+	return t.endRecord()
+}
+
+func (t *tapeWriter) writeHeader(key int64, size int) {
+	if t.text {
+		t.header = strconv.AppendInt(t.header[:0], key, 10)
+		t.header = append(t.header, '\t')
+	} else {
+		length := uint64(size) << 1
+		if t.newRun {
+			length |= 1
+			t.newRun = false
+			t.runs++
+		}
+		t.header = binary.AppendVarint(t.header[:0], key)
+		t.header = binary.AppendUvarint(t.header, length)
+	}
+	t.writer.Write(t.header)
+}
+
+// endRecord finishes the record and reports the first error met while
+// writing it, which bufio.Writer keeps returning once it has failed.
+func (t *tapeWriter) endRecord() error {
+	var err error
+	if t.text {
+		err = t.writer.WriteByte('\n')
+	} else {
+		_, err = t.writer.Write(nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", t.name, err)
+	}
+	return nil
+}
+
+// tapeFile describes the tape once it is closed.
+func (t *tapeWriter) tapeFile() tapeFile {
+	return tapeFile{Path: t.name, Size: t.sum.n, CRC: t.sum.crc, Runs: t.runs}
+}
+
+// Close flushes and closes the tape. Closing it again does nothing.
+func (t *tapeWriter) Close() error {
+	if t.writer == nil {
+		return nil
+	}
+	err := t.writer.Flush()
+	// Let the buffer go: a closed tape may be kept for its tapeFile.
+	t.writer = nil
+	if t.codec != nil {
+		if cerr := t.codec.Close(); err == nil {
+			err = cerr
+		}
+		t.codec = nil
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to write %s: %w", t.name, err)
+	}
+	if t.file != nil {
+		if cerr := t.file.Close(); err == nil {
+			err = cerr
+		}
+		t.disk.resize(t.name, t.sum.n)
+	}
+	return err
+}
+
+// runReader reads the input or a tape run by run.
+type runReader struct {
+	scanner *bufio.Scanner // reads the lines of the input, nil for a tape
+	reader  *bufio.Reader  // reads a tape
+	file    *os.File       // the tape, if opened by openTape
+	codec   *codecReader   // nil when the tape is not compressed
+	key     int64
+	payload []byte
+	rec     Record // the record parsed, once parsed is set
+	parsed  bool
+	byRun   bool // stop at the start of every run
+	starts  bool // the record read starts a run
+	inRun   bool // key and payload hold the next record of the current run
+	eof     bool // all runs have been read
+}
+
+// newInputReader parses the lines of r, which are read as a single run.
+func newInputReader(r io.Reader, bufSize int) (*runReader, error) {
+	t := &runReader{scanner: newScanner(r, bufSize)}
+	return t, t.advance()
+}
+
+// openTape opens the tape name to read it run by run if byRun is set, or
+// else as a single run.
+func openTape(name string, bufSize int, byRun bool, c codec) (*runReader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	t := &runReader{file: file, byRun: byRun}
+	src := c.disk.reader(file)
+	if t.codec, err = c.newReader(src); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if t.codec != nil {
+		t.reader = bufio.NewReaderSize(t.codec, bufSize)
+	} else {
+		t.reader = bufio.NewReaderSize(src, bufSize)
+	}
+	if err := t.advance(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.nextRun()
+	return t, nil
+}
+
+// Close closes the tape opened by openTape.
+func (t *runReader) Close() error {
+	if t.codec != nil {
+		t.codec.Close()
+		t.codec = nil
+	}
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// advance reads the next record of the current run. A record that starts
+// the next run is held until nextRun steps into it.
+func (t *runReader) advance() error {
+	ok, err := t.read()
+	if err != nil {
+		return err
+	}
+	t.eof = !ok
+	t.inRun = ok && !(t.byRun && t.starts)
+	return nil
+}
+
+// read reads the next record, reporting false at the end of the input.
+func (t *runReader) read() (bool, error) {
+	t.parsed = false
+	if t.scanner != nil {
+		if !t.scanner.Scan() {
+			return false, t.scanner.Err()
+		}
+		key, payload, err := splitLine(t.scanner.Bytes())
+		if err != nil {
+			return false, fmt.Errorf("failed to parse line: %w", err)
+		}
+		t.key, t.payload, t.starts = key, payload, false
+		return true, nil
+	}
+
+	key, err := binary.ReadVarint(t.reader)
+	if err == io.EOF {
+		return false, nil
+	}
+	var length, size uint64
+	if err == nil {
+		length, err = binary.ReadUvarint(t.reader)
+		size = length >> 1
+	}
+	if err == nil && size > maxLineSize {
+		err = errors.New("record too long")
+	}
+	if err == nil {
+		t.payload = slices.Grow(t.payload[:0], int(size))[:size]
+		_, err = io.ReadFull(t.reader, t.payload)
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, fmt.Errorf("failed to read tape: %w", err)
+	}
+	t.key, t.starts = key, length&1 != 0
+	return true, nil
+}
+
+// nextRun starts reading the next run once the current one is over.
+func (t *runReader) nextRun() {
+	if !t.eof {
+		t.inRun = true
+	}
+}
+
+// record returns the current record parsed, for a custom Order.Compare.
+func (t *runReader) record() Record {
+	if !t.parsed {
+		t.rec, t.parsed = entryRecord(t.key, t.payload), true
+	}
+	return t.rec
+}
+
+// mergeReaders merges the current runs of the readers, all of which must be
+// in a run, into out in the order of check. Equal records are taken from the
+// readers in slice order. The records and comparisons are counted by check.
+func mergeReaders(check *batchCheck, out *tapeWriter, readers []*runReader) error {
+	tree := NewLoserTree(readers, func(a, b *runReader) bool {
+		check.compares++
+		return check.order.compareReaders(a, b) < 0
+	})
+	for tree.Len() > 0 {
+		_, t := tree.Winner()
+		if err := check.record(t.key, len(t.payload)); err != nil {
+			return err
+		}
+		if err := copyRecord(out, t); err != nil {
+			return err
+		}
+		if t.inRun {
+			tree.Fix()
+		} else {
+			tree.Remove()
+		}
+	}
+	return nil
+}
+
+// copyRecord writes the current record of t to out and advances t.
+func copyRecord(out *tapeWriter, t *runReader) error {
+	if err := out.writeEntry(t.key, t.payload); err != nil {
+		return err
+	}
+	return t.advance()
+}
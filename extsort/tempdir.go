@@ -0,0 +1,215 @@
+package extsort
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tempDirPattern names the job directories, with a random suffix.
+	tempDirPattern = "extsort-*"
+	// ownerFile holds the process id of the sort that owns a job directory.
+	ownerFile = "owner.pid"
+	// primaryFile, in every job directory of a sort but the first, holds
+	// the path of the first, where the manifest of a checkpoint is saved.
+	primaryFile = "primary"
+	// orphanAge is how old a job directory without an owner file must be
+	// before it is taken for an orphan rather than one being set up.
+	orphanAge = time.Minute
+)
+
+// activeTemp holds the job directories and temporary outputs of the sorts
+// in progress.
+var activeTemp = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+func trackTemp(path string) {
+	activeTemp.Lock()
+	activeTemp.paths[path] = true
+	activeTemp.Unlock()
+}
+
+func untrackTemp(path string) {
+	activeTemp.Lock()
+	delete(activeTemp.paths, path)
+	activeTemp.Unlock()
+}
+
+// tempDirs are the directories of the temporary files of one sort: a
+// subdirectory with a unique name in each of the configured directories, so
+// sorts running at the same time never share a file.
+type tempDirs []string
+
+// newTempDirs creates the job directories inside dirs, or inside
+// os.TempDir() if dirs is empty. Each records the process that owns it, and
+// all but the first names the first one, so they are kept along with its
+// checkpoint. The paths are absolute: a checkpoint saves them, and may be
+// resumed from another working directory.
+func newTempDirs(dirs []string) (tempDirs, error) {
+	if len(dirs) == 0 {
+		dirs = []string{os.TempDir()}
+	}
+	var t tempDirs
+	for _, dir := range dirs {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			t.remove()
+			return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		job, err := os.MkdirTemp(dir, tempDirPattern)
+		if err != nil {
+			t.remove()
+			return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		trackTemp(job)
+		t = append(t, job)
+
+		if err := writeOwner(job); err != nil {
+			t.remove()
+			return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		if len(t) > 1 {
+			if err := os.WriteFile(filepath.Join(job, primaryFile), []byte(t[0]), 0644); err != nil {
+				t.remove()
+				return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+			}
+		}
+	}
+	return t, nil
+}
+
+// claimTempDirs takes over the job directories of a sort that is gone, so a
+// checkpointed sort can go on in them.
+func claimTempDirs(dirs []string) (tempDirs, error) {
+	for _, job := range dirs {
+		data, err := os.ReadFile(filepath.Join(job, ownerFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open job %s: %w", job, err)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return nil, fmt.Errorf("job %s is in use by process %d", job, pid)
+		}
+	}
+	t := tempDirs(dirs)
+	for _, job := range t {
+		if err := writeOwner(job); err != nil {
+			return nil, fmt.Errorf("failed to open job %s: %w", job, err)
+		}
+		trackTemp(job)
+	}
+	return t, nil
+}
+
+func writeOwner(job string) error {
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	return os.WriteFile(filepath.Join(job, ownerFile), pid, 0644)
+}
+
+// path returns the path of the temporary file name. Files are spread over
+// the directories in round-robin by i.
+func (t tempDirs) path(i int, name string) string {
+	return filepath.Join(t[i%len(t)], name)
+}
+
+// remove deletes the job directories with whatever files are left in them.
+func (t tempDirs) remove() error {
+	var errs []error
+	for _, dir := range t {
+		errs = append(errs, os.RemoveAll(dir))
+		untrackTemp(dir)
+	}
+	return errors.Join(errs...)
+}
+
+// keep leaves the job directories on disk when the sort returns, and out of
+// reach of RemoveTempFiles.
+func (t tempDirs) keep() {
+	for _, dir := range t {
+		untrackTemp(dir)
+	}
+}
+
+// RemoveTempFiles deletes the temporary files of every sort in progress in
+// this process, including the outputs SortFile has not renamed yet. It is
+// meant for a signal handler that is about to exit: the sorts fail if they
+// go on.
+func RemoveTempFiles() error {
+	activeTemp.Lock()
+	defer activeTemp.Unlock()
+	var errs []error
+	for path := range activeTemp.paths {
+		errs = append(errs, os.RemoveAll(path))
+		delete(activeTemp.paths, path)
+	}
+	return errors.Join(errs...)
+}
+
+// RemoveOrphans deletes the job directories left in dirs, or in
+// os.TempDir() if dirs is empty, by sorts whose process is gone, and
+// returns their paths. With dryRun it only returns them. The jobs of
+// checkpointed sorts that can be resumed are left alone unless resumable is
+// set.
+func RemoveOrphans(dirs []string, dryRun, resumable bool) ([]string, error) {
+	if len(dirs) == 0 {
+		dirs = []string{os.TempDir()}
+	}
+	var orphans []string
+	var errs []error
+	for _, dir := range dirs {
+		jobs, err := filepath.Glob(filepath.Join(dir, tempDirPattern))
+		if err != nil {
+			return orphans, err
+		}
+		for _, job := range jobs {
+			if !isOrphan(job) {
+				continue
+			}
+			if !resumable && hasCheckpoint(job) {
+				continue
+			}
+			orphans = append(orphans, job)
+			if !dryRun {
+				errs = append(errs, os.RemoveAll(job))
+			}
+		}
+	}
+	return orphans, errors.Join(errs...)
+}
+
+// hasCheckpoint reports whether the job directory belongs to a sort with a
+// saved checkpoint: the directory holds the manifest or, for the further
+// directories of a sort, the first directory named in primaryFile does.
+func hasCheckpoint(job string) bool {
+	primary := job
+	if data, err := os.ReadFile(filepath.Join(job, primaryFile)); err == nil {
+		primary = string(data)
+	}
+	_, err := os.Stat(filepath.Join(primary, manifestName))
+	return err == nil
+}
+
+// isOrphan reports whether the job directory belongs to no running sort.
+func isOrphan(job string) bool {
+	info, err := os.Stat(job)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	data, err := os.ReadFile(filepath.Join(job, ownerFile))
+	if err != nil {
+		return time.Since(info.ModTime()) > orphanAge
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return true
+	}
+	return !processAlive(pid)
+}
@@ -0,0 +1,204 @@
+package extsort
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// OrderError reports the first record that sorts before the record before
+// it: by default, whose key is smaller than the key before it.
+type OrderError struct {
+	Line int
+	Prev int64
+	Key  int64
+
+	order Order // the order checked
+}
+
+func (e *OrderError) Error() string {
+	switch {
+	case e.order.Compare != nil:
+		return fmt.Sprintf("line %d: record with key %d sorts before the previous record with key %d", e.Line, e.Key, e.Prev)
+	case e.order.Descending:
+		return fmt.Sprintf("line %d: key %d is greater than previous key %d", e.Line, e.Key, e.Prev)
+	default:
+		return fmt.Sprintf("line %d: key %d is less than previous key %d", e.Line, e.Key, e.Prev)
+	}
+}
+
+// Digest identifies a multiset of records regardless of their order: it
+// counts them and sums a hash of every record, so a file and any
+// permutation of it have the same Digest. A record is hashed parsed, so a
+// key written as 007 counts as 7.
+type Digest struct {
+	Records int64
+	Sum     uint64
+}
+
+// add counts the record with the key and the payload after its tab. The
+// record is hashed with 64-bit FNV-1a, the key first in little-endian order.
+func (d *Digest) add(key int64, payload []byte) {
+	const (
+		offset = 14695981039346656037
+		prime  = 1099511628211
+	)
+	h := uint64(offset)
+	for i := range 8 {
+		h ^= uint64(byte(key >> (8 * i)))
+		h *= prime
+	}
+	for _, b := range payload {
+		h ^= uint64(b)
+		h *= prime
+	}
+	d.Records++
+	d.Sum += mix64(h)
+}
+
+// mix64 spreads the bits of the hash, so that sums of similar records do
+// not cancel out: the finalizer of SplitMix64.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (d Digest) String() string {
+	return fmt.Sprintf("%d records, digest %016x", d.Records, d.Sum)
+}
+
+// IntegrityError reports that a file does not hold the same records as the
+// input it was sorted from.
+type IntegrityError struct {
+	Want Digest
+	Got  Digest
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Got.Records != e.Want.Records {
+		return fmt.Sprintf("%d records, want %d as in the input", e.Got.Records, e.Want.Records)
+	}
+	return fmt.Sprintf("records differ from the input: digest %016x, want %016x", e.Got.Sum, e.Want.Sum)
+}
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	// Digest is the digest of the records read.
+	Digest Digest
+	// Disorders is the number of records that sort before the record
+	// before them, and FirstDisorder the first of them.
+	Disorders     int64
+	FirstDisorder *OrderError
+}
+
+// DigestRecords returns the Digest of the records of r.
+func DigestRecords(r io.Reader) (Digest, error) {
+	var d Digest
+	err := scanRecords(r, func(key int64, payload []byte) {
+		d.add(key, payload)
+	})
+	return d, err
+}
+
+// Verify reads the records of r and checks that their keys never decrease
+// and, if want is not nil, that they are the records want was taken from,
+// in any order. The order is checked over all of the records: the error is
+// an *OrderError for the first record out of order, joined with an
+// *IntegrityError if the records differ. A line that cannot be parsed stops
+// the check with an error naming it.
+func Verify(r io.Reader, want *Digest) (VerifyReport, error) {
+	return Order{}.Verify(r, want)
+}
+
+// Verify checks the records of r as the function Verify does, in the order o
+// instead of by ascending key.
+func (o Order) Verify(r io.Reader, want *Digest) (VerifyReport, error) {
+	var report VerifyReport
+	var prev Record
+	err := scanRecords(r, func(key int64, payload []byte) {
+		rec := Record{Key: key}
+		if o.Compare != nil {
+			rec = entryRecord(key, payload)
+		}
+		line := report.Digest.Records + 1
+		if line > 1 && o.compareRecords(rec, prev) < 0 {
+			if report.Disorders == 0 {
+				report.FirstDisorder = &OrderError{Line: int(line), Prev: prev.Key, Key: key, order: o}
+			}
+			report.Disorders++
+		}
+		prev = rec
+		report.Digest.add(key, payload)
+	})
+	if err != nil {
+		return report, err
+	}
+
+	var errs []error
+	if report.FirstDisorder != nil {
+		errs = append(errs, report.FirstDisorder)
+	}
+	if want != nil && report.Digest != *want {
+		errs = append(errs, &IntegrityError{Want: *want, Got: report.Digest})
+	}
+	if len(errs) == 1 {
+		return report, errs[0]
+	}
+	return report, errors.Join(errs...)
+}
+
+// DigestFile is DigestRecords over the file name.
+func DigestFile(name string) (Digest, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return Digest{}, err
+	}
+	defer f.Close()
+	return DigestRecords(f)
+}
+
+// VerifyFile is Verify over the file name.
+func VerifyFile(name string, want *Digest) (VerifyReport, error) {
+	return Order{}.VerifyFile(name, want)
+}
+
+// VerifyFile is o.Verify over the file name.
+func (o Order) VerifyFile(name string, want *Digest) (VerifyReport, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer f.Close()
+	return o.Verify(f, want)
+}
+
+// CheckSorted reads records from r and returns an *OrderError at the first
+// key that breaks the ascending order. It returns the number of records read.
+func CheckSorted(r io.Reader) (int, error) {
+	report, err := Verify(r, nil)
+	return int(report.Digest.Records), err
+}
+
+// scanRecords parses the lines of r and passes them to record.
+func scanRecords(r io.Reader, record func(key int64, payload []byte)) error {
+	scanner := bufio.NewScanner(r)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		key, payload, err := splitLine(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lines, err)
+		}
+		record(key, payload)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("line %d: %w", lines+1, err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package extsort
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const verifyInput = "3\tc\t2024-01-03\n1\ta\t2024-01-01\n2\tb\t2024-01-02\n2\tb\t2024-01-02\n-7\tz\t2024-01-09\n"
+
+func digestOf(t *testing.T, data string) Digest {
+	t.Helper()
+	d, err := DigestRecords(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDigest(t *testing.T) {
+	want := digestOf(t, verifyInput)
+	if want.Records != 5 {
+		t.Errorf("%d records, want 5", want.Records)
+	}
+	permuted := "2\tb\t2024-01-02\n-7\tz\t2024-01-09\n3\tc\t2024-01-03\n2\tb\t2024-01-02\n01\ta\t2024-01-01\n"
+	if got := digestOf(t, permuted); got != want {
+		t.Errorf("permutation: %v, want %v", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	want := digestOf(t, verifyInput)
+	for _, tc := range []struct {
+		name      string
+		data      string
+		line      int // of the first disorder, 0 if sorted
+		disorders int64
+		integrity bool
+	}{
+		{"sorted", "-7\tz\t2024-01-09\n1\ta\t2024-01-01\n2\tb\t2024-01-02\n2\tb\t2024-01-02\n3\tc\t2024-01-03\n", 0, 0, false},
+		{"input", verifyInput, 2, 2, false},
+		{"last", "1\ta\t2024-01-01\n2\tb\t2024-01-02\n2\tb\t2024-01-02\n3\tc\t2024-01-03\n-7\tz\t2024-01-09\n", 5, 1, false},
+		{"dropped", "-7\tz\t2024-01-09\n1\ta\t2024-01-01\n2\tb\t2024-01-02\n3\tc\t2024-01-03\n", 0, 0, true},
+		{"altered", "-7\tz\t2024-01-09\n1\ta\t2024-01-01\n2\tb\t2024-01-02\n2\tb\t2024-01-03\n3\tc\t2024-01-03\n", 0, 0, true},
+		{"replaced", "-7\tz\t2024-01-09\n1\ta\t2024-01-01\n1\ta\t2024-01-01\n2\tb\t2024-01-02\n3\tc\t2024-01-03\n", 0, 0, true},
+		{"both", "1\ta\t2024-01-01\n-7\tz\t2024-01-09\n2\tb\t2024-01-02\n3\tc\t2024-01-03\n", 2, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			report, err := Verify(strings.NewReader(tc.data), &want)
+			var orderErr *OrderError
+			if errors.As(err, &orderErr) != (tc.line > 0) {
+				t.Fatalf("Verify = %v, want an OrderError: %v", err, tc.line > 0)
+			}
+			if tc.line > 0 && (orderErr.Line != tc.line || report.FirstDisorder != orderErr) {
+				t.Errorf("first disorder %v, want line %d", orderErr, tc.line)
+			}
+			if report.Disorders != tc.disorders {
+				t.Errorf("%d disorders, want %d", report.Disorders, tc.disorders)
+			}
+			var integrityErr *IntegrityError
+			if errors.As(err, &integrityErr) != tc.integrity {
+				t.Fatalf("Verify = %v, want an IntegrityError: %v", err, tc.integrity)
+			}
+			if tc.integrity && integrityErr.Want != want {
+				t.Errorf("integrity error wants %v, want %v", integrityErr.Want, want)
+			}
+			if err == nil && report.Digest != want {
+				t.Errorf("digest %v, want %v", report.Digest, want)
+			}
+		})
+	}
+}
+
+func TestVerifyDescending(t *testing.T) {
+	data := "3\tc\t2024-01-03\n2\tb\t2024-01-02\n2\tb\t2024-01-02\n1\ta\t2024-01-01\n-7\tz\t2024-01-09\n"
+	want := digestOf(t, verifyInput)
+	if _, err := (Order{Descending: true}).Verify(strings.NewReader(data), &want); err != nil {
+		t.Errorf("descending: %v", err)
+	}
+	var orderErr *OrderError
+	if _, err := Verify(strings.NewReader(data), &want); !errors.As(err, &orderErr) || orderErr.Line != 2 || orderErr.Prev != 3 || orderErr.Key != 2 {
+		t.Errorf("ascending: %v, want an OrderError for key 2 after 3 on line 2", err)
+	}
+}
+
+func TestVerifyInvalidLine(t *testing.T) {
+	_, err := Verify(strings.NewReader("1\ta\t2024-01-01\nbad line\n"), nil)
+	var orderErr *OrderError
+	if err == nil || errors.As(err, &orderErr) || !strings.HasPrefix(err.Error(), "line 2: ") {
+		t.Fatalf("Verify = %v, want a parse error on line 2", err)
+	}
+}
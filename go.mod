@@ -0,0 +1,3 @@
+module github.com/ReilEgor/Algo_Lr1_SequentialSortingAlgorithms
+
+go 1.24